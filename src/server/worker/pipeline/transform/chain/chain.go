@@ -2,14 +2,25 @@ package chain
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"reflect"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/pachyderm/pachyderm/src/server/worker/common"
 	"github.com/pachyderm/pachyderm/src/server/worker/datum"
 )
 
+// defaultAncestorWaitWarnAfter is how long a job waits on an ancestor before
+// the chain starts logging stuck-wait warnings, unless overridden.
+const defaultAncestorWaitWarnAfter = 30 * time.Second
+
+// ErrJobCancelled is returned by Next/NextBatch/Process once a job has been
+// cancelled via JobChain.Cancel.
+var ErrJobCancelled = errors.New("chain: job was cancelled")
+
 // Interface - put job into black box
 // only for jobs in the running state
 // black box returns datum.Iterator of datums to be processed as they are safe to be processed
@@ -20,15 +31,46 @@ type DatumHasher interface {
 }
 
 type JobData interface {
+	ID() JobID
 	Iterator() (datum.Iterator, error)
 }
 
+// JobID identifies a job for status-reporting purposes.
+type JobID string
+
 type JobDatumIterator interface {
+	// Next returns the next datum to process, blocking on ancestor jobs as
+	// needed. Like NextBatch, the returned datum is left in-flight until the
+	// caller acknowledges it with Ack once processing has actually
+	// succeeded - Next does not ack on the caller's behalf, so a caller that
+	// fails partway through processing and calls JobChain.Fail does not lose
+	// the datum on retry.
 	Next(context.Context) (bool, error)
+
+	// NextBatch returns up to n datums in one call. It may be called
+	// concurrently with itself and with Next/Process to drain a job's
+	// datums across a worker pool.
+	NextBatch(ctx context.Context, n int) ([][]*common.Input, error)
+
+	// Process drains the job through a bounded pool of concurrency
+	// goroutines, calling fn for each available datum and acknowledging it
+	// only once fn returns nil. It returns the first error from fn or from
+	// the chain itself, cancelling outstanding work; a datum whose fn
+	// returned an error is left in-flight rather than acked, so it is not
+	// silently dropped when the caller retries the job.
+	Process(ctx context.Context, concurrency int, fn func(context.Context, []*common.Input) error) error
+
+	// Ack acknowledges that a datum returned by Next/NextBatch has finished
+	// processing. It is required before Succeed will consider the job done.
+	Ack(datum []*common.Input) error
+
 	Datum() []*common.Input
 	NumAvailable() int
+	InFlight() int
 	AdditiveOnly() bool
 	DatumSet() DatumSet
+	Attempt() int
+	Status() JobStatus
 }
 
 type JobChain interface {
@@ -37,50 +79,241 @@ type JobChain interface {
 
 	Start(jd JobData) (JobDatumIterator, error)
 	Succeed(jd JobData, recoveredDatums DatumSet) error
-	Fail(jd JobData) error
+	Fail(ctx context.Context, jd JobData, err error) error
+
+	// Snapshot returns the current JobStatus of every job still tracked by
+	// the chain, in chain order, for use by metrics/admin endpoints.
+	Snapshot() []JobStatus
+
+	// Stuck returns every job whose current wait on its ancestors has
+	// exceeded AncestorWaitWarnAfter, so a supervisor can fail them
+	// explicitly.
+	Stuck() []StuckJob
+
+	// Cancel stops jd, causing any in-progress Next/NextBatch/Process call to
+	// return ErrJobCancelled and propagating failure to descendants exactly
+	// as Fail does, but without consuming a retry attempt.
+	Cancel(jd JobData) error
+
+	// Pause causes Next/NextBatch/Process calls on jd to block until Resume
+	// is called, without affecting ancestor-wait semantics for other jobs.
+	Pause(jd JobData) error
+	// Resume unblocks Next/NextBatch/Process calls on jd that were paused by
+	// Pause.
+	Resume(jd JobData) error
+}
+
+// RetryPolicy configures how a JobChain retries a job that fails through
+// Fail before giving up and propagating the failure to descendants.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts allowed, including the
+	// first. A value <= 1 disables retries.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between retries. Zero means uncapped.
+	MaxBackoff time.Duration
+	// Multiplier scales the backoff after each attempt. A value <= 1 keeps
+	// the backoff constant at InitialBackoff.
+	Multiplier float64
+	// RetryableErr decides whether a given error should be retried. A nil
+	// RetryableErr treats every error as retryable.
+	RetryableErr func(error) bool
+}
+
+// JobState is the coarse-grained lifecycle state of a job within a JobChain.
+type JobState int
+
+const (
+	// JobStateQueued means the job has been started but has not yet been
+	// classified as running or waiting on an ancestor.
+	JobStateQueued JobState = iota
+	// JobStateWaitingOnAncestors means Next is blocked on one or more
+	// unfinished ancestor jobs.
+	JobStateWaitingOnAncestors
+	// JobStateRunning means the job has datums available to yield.
+	JobStateRunning
+	// JobStateRetrying means the job failed and is sleeping out its backoff
+	// before another attempt.
+	JobStateRetrying
+	// JobStateSucceeded means the job finished successfully.
+	JobStateSucceeded
+	// JobStateFailed means the job exhausted its retries (or hit a
+	// non-retryable error) and will not run again.
+	JobStateFailed
+)
+
+func (s JobState) String() string {
+	switch s {
+	case JobStateQueued:
+		return "Queued"
+	case JobStateWaitingOnAncestors:
+		return "WaitingOnAncestors"
+	case JobStateRunning:
+		return "Running"
+	case JobStateRetrying:
+		return "Retrying"
+	case JobStateSucceeded:
+		return "Succeeded"
+	case JobStateFailed:
+		return "Failed"
+	default:
+		return "Unknown"
+	}
+}
+
+// JobStatus is a point-in-time snapshot of a job's progress through a
+// JobChain, suitable for surfacing on a metrics or admin endpoint.
+type JobStatus struct {
+	State                    JobState
+	TotalDatums              int
+	ProcessedDatums          int
+	SkippedDatums            int
+	RecoveredDatums          int
+	DatumsWaitingOnAncestors int
+	StartedAt                time.Time
+	FirstYieldAt             time.Time
+	FinishedAt               time.Time
+	AncestorJobs             []JobID
+	Attempt                  int
 }
 
-type DatumSet map[string]struct{}
+// StuckJob describes a job whose wait on one or more ancestors has exceeded
+// the chain's AncestorWaitWarnAfter threshold.
+type StuckJob struct {
+	JobID        JobID
+	AncestorJobs []JobID
+	WaitStarted  time.Time
+	WaitElapsed  time.Duration
+}
 
 type jobDatumIterator struct {
 	data JobData
 	jc   *jobChain
 
-	// TODO: lower memory consumption - all these datumsets might result in a
-	// really large memory footprint. See if we can do a streaming interface to
-	// replace these - will likely require the new storage layer, as additive-only
-	// jobs need this stuff the most.
+	// dataMutex guards unyielded/yielding/yielded/inFlight/ancestors/dit/state
+	// below, so that multiple goroutines can drain this job's datums
+	// concurrently via NextBatch/Process. The chain-wide jc.mutex continues
+	// to guard cross-job state (allDatums/finished/success/recoveredDatums of
+	// other jobs, and the jobs slice itself). Code that needs both always
+	// acquires jc.mutex first, then dataMutex, to avoid lock-order deadlocks.
+	dataMutex sync.Mutex
+
 	unyielded       DatumSet // Datums that are waiting on an ancestor job
-	yielding        DatumSet // Datums that may be yielded as the iterator progresses
-	yielded         DatumSet // Datums that have been yielded
+	yielding        DatumSet // Datums that have been determined safe to process but have not been handed to a caller
+	yielded         DatumSet // Datums that have been acknowledged as fully processed
+	inFlight        DatumSet // Datums handed out by NextBatch/Process but not yet Ack'd
 	allDatums       DatumSet // All datum hashes from the datum iterator
 	recoveredDatums DatumSet // Recovered datums from a completed job
 
 	ancestors []*jobDatumIterator
 	dit       datum.Iterator
+	lastDatum []*common.Input // last datum returned by Next, for Datum()
 
 	finished     bool
 	success      bool
 	additiveOnly bool
 	// TODO: have a 'doneProcessing' (for additive-subtractive descendents) and 'doneMerging' (for additive-only decendents)
 	done chan struct{}
+
+	attempt int
+	lastErr error
+
+	state         JobState
+	skippedDatums int
+	startedAt     time.Time
+	firstYieldAt  time.Time
+	finishedAt    time.Time
+	waitStartedAt time.Time // zero when not currently waiting on an ancestor
+
+	cancelled bool
+	cancelCh  chan struct{} // closed by Cancel
+	pauseCh   chan struct{} // non-nil while paused; closed and reset to nil by Resume
 }
 
 type jobChain struct {
-	mutex      sync.Mutex
-	hasher     DatumHasher
-	jobs       []*jobDatumIterator
-	baseDatums DatumSet
+	mutex       sync.Mutex
+	hasher      DatumHasher
+	jobs        []*jobDatumIterator
+	baseDatums  DatumSet
+	retryPolicy RetryPolicy
+
+	// ancestorWaitWarnAfter is how long a job may wait on an ancestor before
+	// fetch starts logging stuck-wait warnings and Stuck starts reporting it.
+	ancestorWaitWarnAfter time.Duration
+
+	// datumSetFactory constructs the DatumSets used for a job's
+	// allDatums/unyielded/yielding/yielded/inFlight. The chain's baseDatums
+	// are not built by it: they come from Initialize or from a finished
+	// job's allDatums. Defaults to an in-memory map; see
+	// NewDiskDatumSetFactory for a bounded-memory alternative.
+	datumSetFactory DatumSetFactory
 }
 
+// ChainOptions configures the optional behaviors of a JobChain.
+type ChainOptions struct {
+	// RetryPolicy controls how a failed job is retried before its failure is
+	// propagated to descendants. The zero value disables retries.
+	RetryPolicy RetryPolicy
+	// AncestorWaitWarnAfter is how long a job may wait on an ancestor before
+	// the chain logs a stuck-wait warning and Stuck starts reporting it. A
+	// value <= 0 uses defaultAncestorWaitWarnAfter.
+	AncestorWaitWarnAfter time.Duration
+	// DatumSetFactory constructs the DatumSets the chain uses to track datum
+	// hashes. A nil value uses NewMapDatumSetFactory; pass
+	// NewDiskDatumSetFactory for pipelines with datum counts too large to
+	// hold in memory.
+	DatumSetFactory DatumSetFactory
+}
+
+// NewJobChain constructs a JobChain that never retries a failed job - this
+// preserves the historical behavior of Fail terminating the job on the first
+// error. Use NewJobChainWithOptions to configure a RetryPolicy or other
+// options.
 func NewJobChain(hasher DatumHasher) (JobChain, error) {
+	return NewJobChainWithOptions(hasher, ChainOptions{RetryPolicy: RetryPolicy{MaxAttempts: 1}})
+}
+
+// NewJobChainWithOptions constructs a JobChain configured by opts.
+func NewJobChainWithOptions(hasher DatumHasher, opts ChainOptions) (JobChain, error) {
+	retryPolicy := opts.RetryPolicy
+	if retryPolicy.MaxAttempts <= 0 {
+		retryPolicy.MaxAttempts = 1
+	}
+	if retryPolicy.Multiplier < 1 {
+		retryPolicy.Multiplier = 1
+	}
+
+	ancestorWaitWarnAfter := opts.AncestorWaitWarnAfter
+	if ancestorWaitWarnAfter <= 0 {
+		ancestorWaitWarnAfter = defaultAncestorWaitWarnAfter
+	}
+
+	datumSetFactory := opts.DatumSetFactory
+	if datumSetFactory == nil {
+		datumSetFactory = NewMapDatumSetFactory()
+	}
+
 	return &jobChain{
-		hasher:     hasher,
-		jobs:       []*jobDatumIterator{},
-		baseDatums: nil,
+		hasher:                hasher,
+		jobs:                  []*jobDatumIterator{},
+		baseDatums:            nil,
+		retryPolicy:           retryPolicy,
+		ancestorWaitWarnAfter: ancestorWaitWarnAfter,
+		datumSetFactory:       datumSetFactory,
 	}, nil
 }
 
+// newDatumSet constructs an empty DatumSet via jc.datumSetFactory, wrapping
+// any error with label to identify which set failed to construct.
+func (jc *jobChain) newDatumSet(label string) (DatumSet, error) {
+	ds, err := jc.datumSetFactory()
+	if err != nil {
+		return nil, fmt.Errorf("creating %s datum set: %v", label, err)
+	}
+	return ds, nil
+}
+
 func (jc *jobChain) Initialized() bool {
 	return jc.baseDatums != nil
 }
@@ -94,9 +327,20 @@ func (jc *jobChain) Initialize(baseDatums DatumSet) error {
 }
 
 func (jdi *jobDatumIterator) recalculate(baseDatums DatumSet, allAncestors []*jobDatumIterator) {
+	// A non-additive retry re-invokes recalculate on a jdi whose ancestors
+	// slice may still hold pointers (some now finished) from the failed
+	// attempt; starting fresh here is what keeps the wait set from
+	// accumulating duplicate or stale ancestors across attempts.
+	jdi.ancestors = nil
+
 	interestingAncestors := map[*jobDatumIterator]struct{}{}
-	for hash := range jdi.allDatums {
-		if _, ok := jdi.yielded[hash]; ok {
+	it := jdi.allDatums.Iterate()
+	for {
+		hash, ok := it.Next()
+		if !ok {
+			break
+		}
+		if jdi.yielded.Contains(hash) {
 			continue
 		}
 
@@ -104,42 +348,42 @@ func (jdi *jobDatumIterator) recalculate(baseDatums DatumSet, allAncestors []*jo
 		// interestingAncestors should be _all_ unfinished previous jobs which have
 		// _any_ datum overlap with this job
 		for _, ancestor := range allAncestors {
-			if !ancestor.finished {
-				if _, ok := ancestor.allDatums[hash]; ok {
-					interestingAncestors[ancestor] = struct{}{}
-					safeToProcess = false
-				}
+			if !ancestor.finished && ancestor.allDatums.Contains(hash) {
+				interestingAncestors[ancestor] = struct{}{}
+				safeToProcess = false
 			}
 		}
 
 		if safeToProcess {
-			jdi.yielding[hash] = struct{}{}
+			jdi.yielding.Add(hash)
 		} else {
-			jdi.unyielded[hash] = struct{}{}
+			jdi.unyielded.Add(hash)
 		}
 	}
+	it.Close()
 
-	// If this job is additive-only from the parent job, we should mark it now - loop over parent datums to see if they are all present
+	// If this job is additive-only from the parent job, it contains every
+	// datum the parent did. Rather than testing each parent datum for
+	// membership in jdi.allDatums one at a time, stream both sorted sets
+	// through a merge-join so that comparing two very large jobs never
+	// requires materializing either one in memory.
 	parentDatums := baseDatums
 	if len(allAncestors) > 0 {
 		parentDatums = allAncestors[len(allAncestors)-1].allDatums
 	}
-	jdi.additiveOnly = true
-	for hash := range parentDatums {
-		if _, ok := jdi.allDatums[hash]; !ok {
-			jdi.additiveOnly = false
-			break
-		}
-	}
+	jdi.additiveOnly = datumSetIsSubset(parentDatums, jdi.allDatums)
 
 	if jdi.additiveOnly {
 		// If this is additive-only, we only need to enqueue new datums (since the parent job)
-		for hash := range jdi.allDatums {
-			if _, ok := parentDatums[hash]; ok {
-				delete(jdi.yielding, hash)
-				delete(jdi.unyielded, hash)
+		datumSetIntersect(parentDatums, jdi.allDatums, func(hash string) {
+			if jdi.yielding.Contains(hash) {
+				jdi.skippedDatums++
+			} else if jdi.unyielded.Contains(hash) {
+				jdi.skippedDatums++
 			}
-		}
+			jdi.yielding.Delete(hash)
+			jdi.unyielded.Delete(hash)
+		})
 		// An additive-only job can only progress once its parent job has finished.
 		// At that point it will re-evaluate what datums to process in case of a
 		// failed job or recovered datums.
@@ -153,6 +397,15 @@ func (jdi *jobDatumIterator) recalculate(baseDatums DatumSet, allAncestors []*jo
 	}
 }
 
+// runStateLocked returns the state a job should be in given its current set
+// of outstanding ancestors.
+func (jdi *jobDatumIterator) runStateLocked() JobState {
+	if len(jdi.ancestors) > 0 {
+		return JobStateWaitingOnAncestors
+	}
+	return JobStateRunning
+}
+
 func (jc *jobChain) Start(jd JobData) (JobDatumIterator, error) {
 	if !jc.Initialized() {
 		return nil, fmt.Errorf("JobChain is not initialized")
@@ -163,29 +416,57 @@ func (jc *jobChain) Start(jd JobData) (JobDatumIterator, error) {
 		return nil, err
 	}
 
+	unyielded, err := jc.newDatumSet("unyielded")
+	if err != nil {
+		return nil, err
+	}
+	yielding, err := jc.newDatumSet("yielding")
+	if err != nil {
+		return nil, err
+	}
+	yielded, err := jc.newDatumSet("yielded")
+	if err != nil {
+		return nil, err
+	}
+	inFlight, err := jc.newDatumSet("in-flight")
+	if err != nil {
+		return nil, err
+	}
+	allDatums, err := jc.newDatumSet("all-datums")
+	if err != nil {
+		return nil, err
+	}
+
 	jdi := &jobDatumIterator{
 		data:      jd,
 		jc:        jc,
-		unyielded: make(DatumSet),
-		yielding:  make(DatumSet),
-		yielded:   make(DatumSet),
-		allDatums: make(DatumSet),
+		unyielded: unyielded,
+		yielding:  yielding,
+		yielded:   yielded,
+		inFlight:  inFlight,
+		allDatums: allDatums,
 		ancestors: []*jobDatumIterator{},
 		dit:       dit,
 		done:      make(chan struct{}),
+		cancelCh:  make(chan struct{}),
+		state:     JobStateQueued,
+		startedAt: time.Now(),
 	}
 
 	jdi.dit.Reset()
 	for i := 0; i < jdi.dit.Len(); i++ {
 		inputs := jdi.dit.DatumN(i)
 		hash := jc.hasher.Hash(inputs)
-		jdi.allDatums[hash] = struct{}{}
+		jdi.allDatums.Add(hash)
 	}
 
 	jc.mutex.Lock()
 	defer jc.mutex.Unlock()
 
+	jdi.dataMutex.Lock()
 	jdi.recalculate(jc.baseDatums, jc.jobs)
+	jdi.state = jdi.runStateLocked()
+	jdi.dataMutex.Unlock()
 
 	fmt.Printf("Starting job (%p) with %d dependencies\n", jdi, len(jdi.ancestors))
 
@@ -219,25 +500,138 @@ func (jc *jobChain) cleanFinishedJobs() {
 	jc.baseDatums = newBaseDatums
 }
 
-func (jc *jobChain) Fail(jd JobData) error {
+// Fail records a failed attempt at processing jd. If the chain's RetryPolicy
+// permits another attempt (the error is retryable and attempts remain), Fail
+// sleeps for the backoff duration for this attempt, respecting ctx, then
+// re-enters the job into the chain at its existing position with a fresh
+// datum.Iterator. Otherwise it terminates the job, propagating failure to
+// descendants exactly as before.
+func (jc *jobChain) Fail(ctx context.Context, jd JobData, failErr error) error {
 	jc.mutex.Lock()
-	defer jc.mutex.Unlock()
 
 	index, err := jc.indexOf(jd)
 	if err != nil {
+		jc.mutex.Unlock()
 		return err
 	}
 
 	jdi := jc.jobs[index]
+	jdi.attempt++
+	jdi.lastErr = failErr
+
+	retryable := jc.retryPolicy.RetryableErr == nil || jc.retryPolicy.RetryableErr(failErr)
+	if !retryable || jdi.attempt >= jc.retryPolicy.MaxAttempts {
+		jc.terminalFail(jdi, failErr)
+		jc.mutex.Unlock()
+		return nil
+	}
+
+	jdi.dataMutex.Lock()
+	jdi.state = JobStateRetrying
+	jdi.dataMutex.Unlock()
+	backoff := retryBackoff(jc.retryPolicy, jdi.attempt)
+	jc.mutex.Unlock()
+
+	select {
+	case <-time.After(backoff):
+	case <-ctx.Done():
+		jc.mutex.Lock()
+		defer jc.mutex.Unlock()
+		jc.terminalFail(jdi, ctx.Err())
+		return nil
+	}
+
+	dit, err := jd.Iterator()
+	if err != nil {
+		jc.mutex.Lock()
+		defer jc.mutex.Unlock()
+		jc.terminalFail(jdi, err)
+		return nil
+	}
+
+	jc.mutex.Lock()
+	defer jc.mutex.Unlock()
+
+	// index was resolved before we dropped jc.mutex for the backoff sleep. A
+	// concurrent Succeed on an earlier job (jc.jobs = jc.jobs[1:]) shifts
+	// every remaining index, so the old value can no longer be trusted to
+	// slice the right set of ancestors - re-resolve it now that jc.mutex is
+	// held again.
+	index, err = jc.indexOf(jd)
+	if err != nil {
+		return err
+	}
+	if jdi.finished {
+		// jdi was cancelled (or otherwise terminated) while Fail was
+		// sleeping out the backoff; don't resurrect it.
+		return nil
+	}
+
+	unyielded, err := jc.newDatumSet("unyielded")
+	if err != nil {
+		jc.terminalFail(jdi, err)
+		return nil
+	}
+	yielding, err := jc.newDatumSet("yielding")
+	if err != nil {
+		jc.terminalFail(jdi, err)
+		return nil
+	}
+
+	jdi.dataMutex.Lock()
+	defer jdi.dataMutex.Unlock()
+
+	// allDatums and yielded are preserved across attempts - only the
+	// not-yet-yielded datums need to be recomputed against the current set of
+	// unfinished ancestors, so that descendants blocked on jdi.done don't wake
+	// up until this job either succeeds or exhausts its retries.
+	jdi.dit = dit
+	jdi.dit.Reset()
+	jdi.unyielded = unyielded
+	jdi.yielding = yielding
+	jdi.recalculate(jc.baseDatums, jc.jobs[:index])
+	jdi.state = jdi.runStateLocked()
+
+	return nil
+}
+
+// terminalFail marks jdi as finished and failed, propagating the failure to
+// descendants. The caller must hold jc.mutex.
+func (jc *jobChain) terminalFail(jdi *jobDatumIterator, failErr error) {
 	jdi.allDatums = nil
 	jdi.finished = true
 	jdi.success = false
+	jdi.lastErr = failErr
+	jdi.finishedAt = time.Now()
+
+	// state is guarded by dataMutex alone (see the jobDatumIterator struct
+	// comment), even though the rest of this function's fields are guarded
+	// by jc.mutex - take it explicitly rather than relying on the caller
+	// already holding it.
+	jdi.dataMutex.Lock()
+	jdi.state = JobStateFailed
+	jdi.dataMutex.Unlock()
 
 	jc.cleanFinishedJobs()
 
 	close(jdi.done)
+}
 
-	return nil
+// retryBackoff computes the backoff duration for the given attempt (1-indexed)
+// under policy, growing geometrically from InitialBackoff and capped at
+// MaxBackoff.
+func retryBackoff(policy RetryPolicy, attempt int) time.Duration {
+	backoff := policy.InitialBackoff
+	for i := 1; i < attempt; i++ {
+		backoff = time.Duration(float64(backoff) * policy.Multiplier)
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			return policy.MaxBackoff
+		}
+	}
+	if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+		return policy.MaxBackoff
+	}
+	return backoff
 }
 
 func (jc *jobChain) Succeed(jd JobData, recoveredDatums DatumSet) error {
@@ -251,20 +645,38 @@ func (jc *jobChain) Succeed(jd JobData, recoveredDatums DatumSet) error {
 
 	jdi := jc.jobs[index]
 
-	if len(jdi.yielding) != 0 || len(jdi.unyielded) != 0 {
+	jdi.dataMutex.Lock()
+	numUnyielded, numYielding, numInFlight := jdi.unyielded.Len(), jdi.yielding.Len(), jdi.inFlight.Len()
+	jdi.dataMutex.Unlock()
+	if numUnyielded+numYielding+numInFlight != 0 {
 		return fmt.Errorf(
-			"cannot succeed a job with remaining datums: %d + %d of %d",
-			len(jdi.unyielded), len(jdi.yielding), len(jdi.unyielded)+len(jdi.yielding)+len(jdi.yielded),
+			"cannot succeed a job with remaining datums: %d unyielded + %d yielding + %d in flight",
+			numUnyielded, numYielding, numInFlight,
 		)
 	}
 
-	for hash := range recoveredDatums {
-		delete(jdi.allDatums, hash)
+	if recoveredDatums != nil {
+		it := recoveredDatums.Iterate()
+		for {
+			hash, ok := it.Next()
+			if !ok {
+				break
+			}
+			jdi.allDatums.Delete(hash)
+		}
+		it.Close()
 	}
 
 	jdi.recoveredDatums = recoveredDatums
 	jdi.finished = true
 	jdi.success = true
+	// state is guarded by dataMutex alone (see the jobDatumIterator struct
+	// comment); take it explicitly since the rest of Succeed only holds
+	// jc.mutex.
+	jdi.dataMutex.Lock()
+	jdi.state = JobStateSucceeded
+	jdi.dataMutex.Unlock()
+	jdi.finishedAt = time.Now()
 
 	if index == 0 {
 		jc.jobs = jc.jobs[1:]
@@ -280,53 +692,190 @@ func (jc *jobChain) Succeed(jd JobData, recoveredDatums DatumSet) error {
 
 func safeToProcess(hash string, ancestors []*jobDatumIterator) bool {
 	for _, ancestor := range ancestors {
-		if _, ok := ancestor.allDatums[hash]; ok {
+		// terminalFail clears allDatums on a finished ancestor, so this must
+		// go through the nil-safe wrapper rather than calling Contains
+		// directly.
+		if datumSetContains(ancestor.allDatums, hash) {
 			return false
 		}
 	}
 	return true
 }
 
-func (jdi *jobDatumIterator) Next(ctx context.Context) (bool, error) {
+// waitForAncestor blocks until one of jdi.ancestors finishes or ctx is done,
+// returning the ancestor that finished. If the wait outlasts the chain's
+// AncestorWaitWarnAfter threshold, it logs a structured warning identifying
+// the waiting job, the outstanding ancestors and their remaining datums, and
+// the elapsed time, repeating at a geometrically increasing interval until
+// the wait resolves. The caller must hold jdi.dataMutex; it is released for
+// the duration of the wait and re-acquired before returning.
+func (jdi *jobDatumIterator) waitForAncestor(ctx context.Context) (*jobDatumIterator, error) {
+	ancestors := append([]*jobDatumIterator(nil), jdi.ancestors...)
+	waitStarted := jdi.waitStartedAt
+	warnAfter := jdi.jc.ancestorWaitWarnAfter
+	cancelCh := jdi.cancelCh
+
+	jdi.dataMutex.Unlock()
+	defer jdi.dataMutex.Lock()
+
+	cases := make([]reflect.SelectCase, 0, len(ancestors)+3)
+	for _, x := range ancestors {
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(x.done)})
+	}
+	ctxCase := len(cases)
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())})
+	cancelCase := len(cases)
+	cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(cancelCh)})
+
+	var timer *time.Timer
+	timerCase := -1
+	if warnAfter > 0 {
+		timer = time.NewTimer(warnAfter)
+		defer timer.Stop()
+		timerCase = len(cases)
+		cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(timer.C)})
+	}
+
+	interval := warnAfter
+	for {
+		index, _, _ := reflect.Select(cases)
+		switch index {
+		case ctxCase:
+			return nil, ctx.Err()
+		case cancelCase:
+			return nil, ErrJobCancelled
+		case timerCase:
+			logStuckWait(jdi, ancestors, waitStarted)
+			interval *= 2
+			timer.Reset(interval)
+		default:
+			return ancestors[index], nil
+		}
+	}
+}
+
+// waitWhilePausedOrCancelled blocks fetch while jdi is paused, returning
+// ErrJobCancelled immediately if jdi is cancelled (or becomes cancelled while
+// paused) and ctx.Err() if ctx is done first. The caller must hold
+// jdi.dataMutex; it is released for the duration of any wait and re-acquired
+// before returning.
+func (jdi *jobDatumIterator) waitWhilePausedOrCancelled(ctx context.Context) error {
+	for {
+		select {
+		case <-jdi.cancelCh:
+			return ErrJobCancelled
+		default:
+		}
+
+		if jdi.pauseCh == nil {
+			return nil
+		}
+		pauseCh := jdi.pauseCh
+		cancelCh := jdi.cancelCh
+
+		jdi.dataMutex.Unlock()
+		select {
+		case <-pauseCh:
+			jdi.dataMutex.Lock()
+		case <-cancelCh:
+			jdi.dataMutex.Lock()
+		case <-ctx.Done():
+			jdi.dataMutex.Lock()
+			return ctx.Err()
+		}
+	}
+}
+
+// logStuckWait logs a structured warning that jdi has been waiting on
+// ancestors longer than the warn threshold.
+func logStuckWait(jdi *jobDatumIterator, ancestors []*jobDatumIterator, waitStarted time.Time) {
+	outstanding := make([]string, 0, len(ancestors))
+	for _, ancestor := range ancestors {
+		select {
+		case <-ancestor.done:
+			continue
+		default:
+		}
+		ancestor.dataMutex.Lock()
+		remaining := ancestor.yielding.Len() + ancestor.unyielded.Len() + ancestor.inFlight.Len()
+		ancestor.dataMutex.Unlock()
+		outstanding = append(outstanding, fmt.Sprintf("%p(%d datums remaining)", ancestor, remaining))
+	}
+
+	fmt.Printf(
+		"job (%p) stuck waiting %s on %d ancestor(s): %s\n",
+		jdi, time.Since(waitStarted).Round(time.Second), len(outstanding), strings.Join(outstanding, ", "),
+	)
+}
+
+// fetch returns the next available datum for this job, blocking on ancestor
+// completion as needed, and marks it in-flight. Multiple goroutines may call
+// fetch concurrently for the same job - dataMutex is dropped while blocked on
+// an ancestor so that wait alone doesn't serialize the whole pool, and is
+// otherwise held just long enough to update the job's local bookkeeping.
+func (jdi *jobDatumIterator) fetch(ctx context.Context) ([]*common.Input, bool, error) {
+	jdi.dataMutex.Lock()
 	for {
-		for len(jdi.yielding) == 0 {
+		if err := jdi.waitWhilePausedOrCancelled(ctx); err != nil {
+			jdi.dataMutex.Unlock()
+			return nil, false, err
+		}
+
+		for jdi.yielding.Len() == 0 {
 			if len(jdi.ancestors) == 0 {
-				if len(jdi.unyielded) != 0 {
-					return false, fmt.Errorf("job has unyielded datums but is not waiting on anything")
+				if jdi.unyielded.Len() != 0 {
+					jdi.dataMutex.Unlock()
+					return nil, false, fmt.Errorf("job has unyielded datums but is not waiting on anything")
 				}
 				fmt.Printf("Finishing job (%p) with no dependencies\n", jdi)
-				return false, nil
+				jdi.dataMutex.Unlock()
+				return nil, false, nil
 			}
 
-			// Wait on an ancestor job
-			cases := make([]reflect.SelectCase, 0, len(jdi.ancestors)+1)
-			for _, x := range jdi.ancestors {
-				cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(x.done)})
+			jdi.state = JobStateWaitingOnAncestors
+			jdi.waitStartedAt = time.Now()
+
+			// Wait for an ancestor job to finish, then remove it from our
+			// dependencies. waitForAncestor drops dataMutex while blocked so
+			// a concurrent fetch on this job isn't held up by the wait.
+			ancestor, err := jdi.waitForAncestor(ctx)
+			if err != nil {
+				jdi.dataMutex.Unlock()
+				return nil, false, err
 			}
-			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())})
+			jdi.waitStartedAt = time.Time{}
 
-			// Wait for an ancestor job to finish, then remove it from our dependencies
-			index, _, _ := reflect.Select(cases)
-			if index == len(cases)-1 {
-				return false, ctx.Err()
+			for i, a := range jdi.ancestors {
+				if a == ancestor {
+					jdi.ancestors = append(jdi.ancestors[:i], jdi.ancestors[i+1:]...)
+					break
+				}
 			}
-			ancestor := jdi.ancestors[index]
-			jdi.ancestors = append(jdi.ancestors[:index], jdi.ancestors[index+1:]...)
 
 			fmt.Printf("Job (%p) finished wait (on %p), %d remaining dependencies\n", jdi, ancestor, len(jdi.ancestors))
 			if jdi.additiveOnly {
 				if len(jdi.ancestors) != 0 {
-					return false, fmt.Errorf("additive-only job had multiple ancestors")
+					jdi.dataMutex.Unlock()
+					return nil, false, fmt.Errorf("additive-only job had multiple ancestors")
 				}
 				// Now that our parent job has completed, we need to update our DatumSets:
 				// 1. If the job succeeded and there were no recovered datums, we're done
 				// 2. If the job succeeded and there were recovered datums, copy them to yielding
 				// 3. If the job failed, we need to redetermine all remaining datums
 				if ancestor.success {
-					for hash := range ancestor.recoveredDatums {
-						jdi.yielding[hash] = struct{}{}
+					if ancestor.recoveredDatums != nil {
+						it := ancestor.recoveredDatums.Iterate()
+						for {
+							hash, ok := it.Next()
+							if !ok {
+								break
+							}
+							jdi.yielding.Add(hash)
+						}
+						it.Close()
 					}
 				} else {
+					jdi.dataMutex.Unlock()
 					if err := func() error {
 						jdi.jc.mutex.Lock()
 						defer jdi.jc.mutex.Unlock()
@@ -334,47 +883,207 @@ func (jdi *jobDatumIterator) Next(ctx context.Context) (bool, error) {
 						if err != nil {
 							return err
 						}
+						unyielded, err := jdi.jc.newDatumSet("unyielded")
+						if err != nil {
+							return err
+						}
+						yielding, err := jdi.jc.newDatumSet("yielding")
+						if err != nil {
+							return err
+						}
+						jdi.dataMutex.Lock()
+						defer jdi.dataMutex.Unlock()
+						// recalculate Adds every not-yet-yielded hash again, so start
+						// from empty sets rather than Adding on top of the old ones.
+						jdi.unyielded = unyielded
+						jdi.yielding = yielding
 						jdi.recalculate(jdi.jc.baseDatums, jdi.jc.jobs[:index])
 						return nil
 					}(); err != nil {
-						return false, err
+						return nil, false, err
 					}
+					jdi.dataMutex.Lock()
 				}
 			}
 
 			// TODO: update 'yielding' from 'unyielded'
-			for hash := range jdi.unyielded {
+			//
+			// safeToProcess reads allDatums of jdi.ancestors, which belongs to
+			// other jobs and is guarded by jc.mutex, not jdi.dataMutex - take
+			// it here (dropping and re-acquiring dataMutex to keep the usual
+			// jc.mutex-then-dataMutex order) so a concurrent Succeed deleting
+			// recovered hashes from an ancestor's allDatums can't race with
+			// this read.
+			jdi.dataMutex.Unlock()
+			jdi.jc.mutex.Lock()
+			jdi.dataMutex.Lock()
+			unyieldedIt := jdi.unyielded.Iterate()
+			for {
+				hash, ok := unyieldedIt.Next()
+				if !ok {
+					break
+				}
 				if safeToProcess(hash, jdi.ancestors) {
-					delete(jdi.unyielded, hash)
-					jdi.yielding[hash] = struct{}{}
+					jdi.unyielded.Delete(hash)
+					jdi.yielding.Add(hash)
 				}
 			}
+			unyieldedIt.Close()
+			jdi.jc.mutex.Unlock()
 
 			jdi.dit.Reset()
 		}
 
+		jdi.state = JobStateRunning
+
 		for jdi.dit.Next() {
 			inputs := jdi.dit.Datum()
 			hash := jdi.jc.hasher.Hash(inputs)
-			if _, ok := jdi.yielding[hash]; ok {
-				delete(jdi.yielding, hash)
-				jdi.yielded[hash] = struct{}{}
-				return true, nil
+			if jdi.yielding.Contains(hash) {
+				jdi.yielding.Delete(hash)
+				// A datum left in flight by a failed attempt is already here.
+				if !jdi.inFlight.Contains(hash) {
+					jdi.inFlight.Add(hash)
+				}
+				if jdi.firstYieldAt.IsZero() {
+					jdi.firstYieldAt = time.Now()
+				}
+				jdi.dataMutex.Unlock()
+				return inputs, true, nil
 			}
 		}
 
-		if len(jdi.yielding) != 0 {
-			return false, fmt.Errorf("%d unhandled datums were not yielded during iteration", len(jdi.yielding))
+		if jdi.yielding.Len() != 0 {
+			jdi.dataMutex.Unlock()
+			return nil, false, fmt.Errorf("%d unhandled datums were not yielded during iteration", jdi.yielding.Len())
+		}
+	}
+}
+
+// Next returns the next datum to process, blocking on ancestor jobs as
+// needed. It is meant for a single-threaded caller; use NextBatch/Process to
+// drain a job across a worker pool. The caller must call Ack once it has
+// actually finished processing the datum - Next no longer acks on the
+// caller's behalf, since doing so before the datum was processed let a
+// failed datum get marked done and silently dropped on retry.
+func (jdi *jobDatumIterator) Next(ctx context.Context) (bool, error) {
+	inputs, ok, err := jdi.fetch(ctx)
+	if !ok {
+		return false, err
+	}
+
+	jdi.dataMutex.Lock()
+	jdi.lastDatum = inputs
+	jdi.dataMutex.Unlock()
+
+	return true, nil
+}
+
+// NextBatch returns up to n datums, fetched one at a time via fetch so that
+// concurrent callers on the same job interleave safely. Like Next, it blocks
+// while the job's remaining datums wait on an ancestor; it stops early,
+// without error, once the job has no datums left to yield.
+func (jdi *jobDatumIterator) NextBatch(ctx context.Context, n int) ([][]*common.Input, error) {
+	batch := make([][]*common.Input, 0, n)
+	for len(batch) < n {
+		inputs, ok, err := jdi.fetch(ctx)
+		if err != nil {
+			return batch, err
+		}
+		if !ok {
+			break
 		}
+		batch = append(batch, inputs)
+	}
+	return batch, nil
+}
+
+// Process drains the job through a bounded pool of concurrency goroutines,
+// calling fn for each datum and acknowledging it only once fn returns nil.
+// It stops and returns the first error encountered, from fn or from the
+// chain itself, cancelling the remaining workers. A datum whose fn failed is
+// left in-flight rather than acked, so it isn't dropped on a retried attempt.
+func (jdi *jobDatumIterator) Process(ctx context.Context, concurrency int, fn func(context.Context, []*common.Input) error) error {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				inputs, ok, err := jdi.fetch(ctx)
+				if err != nil {
+					errOnce.Do(func() { firstErr = err; cancel() })
+					return
+				}
+				if !ok {
+					return
+				}
+
+				if err := fn(ctx, inputs); err != nil {
+					errOnce.Do(func() { firstErr = err; cancel() })
+					return
+				}
+				if err := jdi.Ack(inputs); err != nil {
+					errOnce.Do(func() { firstErr = err; cancel() })
+					return
+				}
+			}
+		}()
 	}
+
+	wg.Wait()
+	return firstErr
 }
 
+// NumAvailable returns the number of datums that are safe to process but
+// have not yet been handed out by Next/NextBatch/Process. It does not
+// include in-flight datums - see InFlight.
 func (jdi *jobDatumIterator) NumAvailable() int {
-	return len(jdi.yielding)
+	jdi.dataMutex.Lock()
+	defer jdi.dataMutex.Unlock()
+	return jdi.yielding.Len()
+}
+
+// InFlight returns the number of datums that have been handed out but not
+// yet acknowledged via Ack.
+func (jdi *jobDatumIterator) InFlight() int {
+	jdi.dataMutex.Lock()
+	defer jdi.dataMutex.Unlock()
+	return jdi.inFlight.Len()
+}
+
+// Ack acknowledges that a datum returned by NextBatch (or passed to a
+// Process callback) has finished processing.
+func (jdi *jobDatumIterator) Ack(datum []*common.Input) error {
+	hash := jdi.jc.hasher.Hash(datum)
+
+	jdi.dataMutex.Lock()
+	defer jdi.dataMutex.Unlock()
+
+	if !jdi.inFlight.Contains(hash) {
+		return fmt.Errorf("datum is not in flight")
+	}
+	jdi.inFlight.Delete(hash)
+	jdi.yielded.Add(hash)
+	return nil
 }
 
 func (jdi *jobDatumIterator) Datum() []*common.Input {
-	return jdi.dit.Datum()
+	jdi.dataMutex.Lock()
+	defer jdi.dataMutex.Unlock()
+	return jdi.lastDatum
 }
 
 func (jdi *jobDatumIterator) DatumSet() DatumSet {
@@ -383,4 +1092,164 @@ func (jdi *jobDatumIterator) DatumSet() DatumSet {
 
 func (jdi *jobDatumIterator) AdditiveOnly() bool {
 	return jdi.additiveOnly
-}
\ No newline at end of file
+}
+
+// Attempt returns the number of times Fail has been called for this job,
+// including a final failure that was not retried. It is zero until the
+// first call to Fail.
+func (jdi *jobDatumIterator) Attempt() int {
+	return jdi.attempt
+}
+
+// Status returns a point-in-time snapshot of this job's progress.
+func (jdi *jobDatumIterator) Status() JobStatus {
+	jdi.jc.mutex.Lock()
+	defer jdi.jc.mutex.Unlock()
+	jdi.dataMutex.Lock()
+	defer jdi.dataMutex.Unlock()
+	return jdi.statusLocked()
+}
+
+// statusLocked builds a JobStatus from the current state of jdi. The caller
+// must hold jdi.jc.mutex and jdi.dataMutex.
+func (jdi *jobDatumIterator) statusLocked() JobStatus {
+	ancestorJobs := make([]JobID, len(jdi.ancestors))
+	for i, ancestor := range jdi.ancestors {
+		ancestorJobs[i] = ancestor.data.ID()
+	}
+	return JobStatus{
+		State:                    jdi.state,
+		TotalDatums:              datumSetLen(jdi.allDatums),
+		ProcessedDatums:          jdi.yielded.Len(),
+		SkippedDatums:            jdi.skippedDatums,
+		RecoveredDatums:          datumSetLen(jdi.recoveredDatums),
+		DatumsWaitingOnAncestors: jdi.unyielded.Len(),
+		StartedAt:                jdi.startedAt,
+		FirstYieldAt:             jdi.firstYieldAt,
+		FinishedAt:               jdi.finishedAt,
+		AncestorJobs:             ancestorJobs,
+		Attempt:                  jdi.attempt,
+	}
+}
+
+// Snapshot returns the JobStatus of every job still tracked by the chain, in
+// chain order.
+func (jc *jobChain) Snapshot() []JobStatus {
+	jc.mutex.Lock()
+	defer jc.mutex.Unlock()
+
+	statuses := make([]JobStatus, len(jc.jobs))
+	for i, jdi := range jc.jobs {
+		jdi.dataMutex.Lock()
+		statuses[i] = jdi.statusLocked()
+		jdi.dataMutex.Unlock()
+	}
+	return statuses
+}
+
+// Stuck returns every job whose current wait on its ancestors has exceeded
+// AncestorWaitWarnAfter, so a supervisor can fail them explicitly.
+func (jc *jobChain) Stuck() []StuckJob {
+	jc.mutex.Lock()
+	defer jc.mutex.Unlock()
+
+	var stuck []StuckJob
+	for _, jdi := range jc.jobs {
+		jdi.dataMutex.Lock()
+		waitStarted := jdi.waitStartedAt
+		ancestors := append([]*jobDatumIterator(nil), jdi.ancestors...)
+		jdi.dataMutex.Unlock()
+
+		if waitStarted.IsZero() {
+			continue
+		}
+		elapsed := time.Since(waitStarted)
+		if elapsed < jc.ancestorWaitWarnAfter {
+			continue
+		}
+
+		ancestorIDs := make([]JobID, len(ancestors))
+		for i, ancestor := range ancestors {
+			ancestorIDs[i] = ancestor.data.ID()
+		}
+		stuck = append(stuck, StuckJob{
+			JobID:        jdi.data.ID(),
+			AncestorJobs: ancestorIDs,
+			WaitStarted:  waitStarted,
+			WaitElapsed:  elapsed,
+		})
+	}
+	return stuck
+}
+
+// Cancel stops jd. Any goroutine currently blocked in Next/NextBatch/Process
+// for jd wakes up and returns ErrJobCancelled. Like Fail, it closes jdi.done
+// with success=false so additive-only descendants are unblocked and
+// re-evaluate their remaining work - but it does not touch jdi.attempt, so a
+// cancelled job does not consume a retry.
+func (jc *jobChain) Cancel(jd JobData) error {
+	jc.mutex.Lock()
+	defer jc.mutex.Unlock()
+
+	index, err := jc.indexOf(jd)
+	if err != nil {
+		return err
+	}
+	jdi := jc.jobs[index]
+
+	if jdi.finished {
+		return fmt.Errorf("job has already finished")
+	}
+
+	jdi.dataMutex.Lock()
+	if !jdi.cancelled {
+		jdi.cancelled = true
+		close(jdi.cancelCh)
+	}
+	jdi.dataMutex.Unlock()
+
+	jc.terminalFail(jdi, ErrJobCancelled)
+	return nil
+}
+
+// Pause causes Next/NextBatch/Process calls on jd to block (respecting their
+// ctx) until Resume is called. It has no effect on any other job in the
+// chain, including jd's ancestors or descendants.
+func (jc *jobChain) Pause(jd JobData) error {
+	jc.mutex.Lock()
+	defer jc.mutex.Unlock()
+
+	index, err := jc.indexOf(jd)
+	if err != nil {
+		return err
+	}
+	jdi := jc.jobs[index]
+
+	jdi.dataMutex.Lock()
+	defer jdi.dataMutex.Unlock()
+	if jdi.pauseCh == nil {
+		jdi.pauseCh = make(chan struct{})
+	}
+	return nil
+}
+
+// Resume unblocks Next/NextBatch/Process calls on jd that were paused by
+// Pause.
+func (jc *jobChain) Resume(jd JobData) error {
+	jc.mutex.Lock()
+	defer jc.mutex.Unlock()
+
+	index, err := jc.indexOf(jd)
+	if err != nil {
+		return err
+	}
+	jdi := jc.jobs[index]
+
+	jdi.dataMutex.Lock()
+	defer jdi.dataMutex.Unlock()
+	if jdi.pauseCh != nil {
+		close(jdi.pauseCh)
+		jdi.pauseCh = nil
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package chain
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pachyderm/pachyderm/src/server/worker/common"
+)
+
+func TestCancelUnblocksDescendantWithoutConsumingRetry(t *testing.T) {
+	hasher := &pointerHasher{}
+	jc, err := NewJobChainWithOptions(hasher, ChainOptions{
+		RetryPolicy: RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Multiplier: 1},
+	})
+	if err != nil {
+		t.Fatalf("NewJobChainWithOptions: %v", err)
+	}
+	if err := jc.Initialize(newMapDatumSet()); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+
+	shared := newDatums(1)[0]
+	parent := &fakeJobData{id: "parent", datums: [][]*common.Input{shared}}
+	parentIt, err := jc.Start(parent)
+	if err != nil {
+		t.Fatalf("Start(parent): %v", err)
+	}
+
+	// Additive-only child whose only datum is the parent's, so it has nothing
+	// to yield until the parent finishes.
+	child := &fakeJobData{id: "child", datums: [][]*common.Input{shared}}
+	childIt, err := jc.Start(child)
+	if err != nil {
+		t.Fatalf("Start(child): %v", err)
+	}
+
+	ctx := context.Background()
+	done := make(chan error, 1)
+	go func() {
+		_, err := childIt.Next(ctx) // blocks waiting on parent
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	if err := jc.Cancel(parent); err != nil {
+		t.Fatalf("Cancel(parent): %v", err)
+	}
+	if got := parentIt.Attempt(); got != 0 {
+		t.Fatalf("Attempt() after Cancel = %d, want 0 (Cancel must not consume a retry)", got)
+	}
+	if err := jc.Cancel(parent); err == nil {
+		t.Fatalf("Cancel on an already-finished job should error")
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("child Next() after parent cancelled: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("child never unblocked after parent was cancelled")
+	}
+	if err := childIt.Ack(childIt.Datum()); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+}
+
+func TestPauseBlocksNextUntilResume(t *testing.T) {
+	hasher := &pointerHasher{}
+	jc, err := NewJobChain(hasher)
+	if err != nil {
+		t.Fatalf("NewJobChain: %v", err)
+	}
+	if err := jc.Initialize(newMapDatumSet()); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+
+	jd := &fakeJobData{id: "job", datums: newDatums(1)}
+	jdi, err := jc.Start(jd)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	if err := jc.Pause(jd); err != nil {
+		t.Fatalf("Pause: %v", err)
+	}
+
+	ctx := context.Background()
+	done := make(chan error, 1)
+	go func() {
+		_, err := jdi.Next(ctx)
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("Next returned while job was paused")
+	case <-time.After(30 * time.Millisecond):
+	}
+
+	if err := jc.Resume(jd); err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Next after Resume: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Next never returned after Resume")
+	}
+}
@@ -0,0 +1,125 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/pachyderm/pachyderm/src/server/worker/common"
+)
+
+func TestNextBatchDrainsAllDatums(t *testing.T) {
+	hasher := &pointerHasher{}
+	jc, err := NewJobChain(hasher)
+	if err != nil {
+		t.Fatalf("NewJobChain: %v", err)
+	}
+	if err := jc.Initialize(newMapDatumSet()); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+
+	jd := &fakeJobData{id: "job", datums: newDatums(5)}
+	jdi, err := jc.Start(jd)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	ctx := context.Background()
+	batch, err := jdi.NextBatch(ctx, 10)
+	if err != nil {
+		t.Fatalf("NextBatch: %v", err)
+	}
+	if len(batch) != 5 {
+		t.Fatalf("NextBatch returned %d datums, want 5", len(batch))
+	}
+	for _, datum := range batch {
+		if err := jdi.Ack(datum); err != nil {
+			t.Fatalf("Ack: %v", err)
+		}
+	}
+	if err := jc.Succeed(jd, nil); err != nil {
+		t.Fatalf("Succeed: %v", err)
+	}
+}
+
+func TestProcessRunsEachDatumExactlyOnce(t *testing.T) {
+	hasher := &pointerHasher{}
+	jc, err := NewJobChain(hasher)
+	if err != nil {
+		t.Fatalf("NewJobChain: %v", err)
+	}
+	if err := jc.Initialize(newMapDatumSet()); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+
+	const n = 50
+	jd := &fakeJobData{id: "job", datums: newDatums(n)}
+	jdi, err := jc.Start(jd)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	var mu sync.Mutex
+	seen := map[string]int{}
+	ctx := context.Background()
+	if err := jdi.Process(ctx, 8, func(ctx context.Context, datum []*common.Input) error {
+		hash := hasher.Hash(datum)
+		mu.Lock()
+		seen[hash]++
+		mu.Unlock()
+		return nil
+	}); err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+
+	if len(seen) != n {
+		t.Fatalf("Process handled %d distinct datums, want %d", len(seen), n)
+	}
+	for hash, count := range seen {
+		if count != 1 {
+			t.Fatalf("datum %s processed %d times, want 1", hash, count)
+		}
+	}
+	if err := jc.Succeed(jd, nil); err != nil {
+		t.Fatalf("Succeed: %v", err)
+	}
+}
+
+// TestProcessDoesNotAckFailedDatum is a regression test for Process acking a
+// datum unconditionally, even when fn returned an error for it - which, once
+// retries existed, meant the failed datum was skipped forever by
+// recalculate on the retried attempt.
+func TestProcessDoesNotAckFailedDatum(t *testing.T) {
+	hasher := &pointerHasher{}
+	jc, err := NewJobChain(hasher)
+	if err != nil {
+		t.Fatalf("NewJobChain: %v", err)
+	}
+	if err := jc.Initialize(newMapDatumSet()); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+
+	jd := &fakeJobData{id: "job", datums: newDatums(1)}
+	jdi, err := jc.Start(jd)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	jdiConcrete := jdi.(*jobDatumIterator)
+
+	wantErr := errors.New("processing failed")
+	ctx := context.Background()
+	if err := jdi.Process(ctx, 1, func(ctx context.Context, datum []*common.Input) error {
+		return wantErr
+	}); err != wantErr {
+		t.Fatalf("Process error = %v, want %v", err, wantErr)
+	}
+
+	hash := hasher.Hash(jd.datums[0])
+	if jdiConcrete.yielded.Contains(hash) {
+		t.Fatalf("failed datum was acked into yielded, so a retry would never see it again")
+	}
+	if !jdiConcrete.inFlight.Contains(hash) {
+		t.Fatalf("failed datum should remain in-flight, not be silently dropped")
+	}
+}
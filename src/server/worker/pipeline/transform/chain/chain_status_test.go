@@ -0,0 +1,108 @@
+package chain
+
+import (
+	"context"
+	"testing"
+)
+
+func TestJobStatusReflectsProgress(t *testing.T) {
+	hasher := &pointerHasher{}
+	jc, err := NewJobChain(hasher)
+	if err != nil {
+		t.Fatalf("NewJobChain: %v", err)
+	}
+	if err := jc.Initialize(newMapDatumSet()); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+
+	jd := &fakeJobData{id: "job", datums: newDatums(3)}
+	jdi, err := jc.Start(jd)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	status := jdi.Status()
+	if status.State != JobStateRunning {
+		t.Fatalf("State before any Next = %v, want Running", status.State)
+	}
+	if status.TotalDatums != 3 {
+		t.Fatalf("TotalDatums = %d, want 3", status.TotalDatums)
+	}
+	if !status.FirstYieldAt.IsZero() {
+		t.Fatalf("FirstYieldAt should be zero before the first Next")
+	}
+
+	ctx := context.Background()
+	if ok, err := jdi.Next(ctx); err != nil || !ok {
+		t.Fatalf("Next = %v, %v, want a datum", ok, err)
+	}
+	if err := jdi.Ack(jdi.Datum()); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+
+	status = jdi.Status()
+	if status.ProcessedDatums != 1 {
+		t.Fatalf("ProcessedDatums = %d, want 1", status.ProcessedDatums)
+	}
+	if status.FirstYieldAt.IsZero() {
+		t.Fatalf("FirstYieldAt should be set after the first Next")
+	}
+	if status.StartedAt.IsZero() {
+		t.Fatalf("StartedAt should be set from Start")
+	}
+
+	for {
+		ok, err := jdi.Next(ctx)
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if !ok {
+			break
+		}
+		if err := jdi.Ack(jdi.Datum()); err != nil {
+			t.Fatalf("Ack: %v", err)
+		}
+	}
+	if err := jc.Succeed(jd, nil); err != nil {
+		t.Fatalf("Succeed: %v", err)
+	}
+
+	status = jdi.Status()
+	if status.State != JobStateSucceeded {
+		t.Fatalf("State after Succeed = %v, want Succeeded", status.State)
+	}
+	if status.ProcessedDatums != 3 {
+		t.Fatalf("ProcessedDatums after Succeed = %d, want 3", status.ProcessedDatums)
+	}
+	if status.FinishedAt.IsZero() {
+		t.Fatalf("FinishedAt should be set after Succeed")
+	}
+}
+
+func TestSnapshotListsEveryTrackedJob(t *testing.T) {
+	hasher := &pointerHasher{}
+	jc, err := NewJobChain(hasher)
+	if err != nil {
+		t.Fatalf("NewJobChain: %v", err)
+	}
+	if err := jc.Initialize(newMapDatumSet()); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+
+	jd1 := &fakeJobData{id: "job1", datums: newDatums(1)}
+	jd2 := &fakeJobData{id: "job2", datums: newDatums(1)}
+	if _, err := jc.Start(jd1); err != nil {
+		t.Fatalf("Start(jd1): %v", err)
+	}
+	if _, err := jc.Start(jd2); err != nil {
+		t.Fatalf("Start(jd2): %v", err)
+	}
+
+	snap := jc.Snapshot()
+	if len(snap) != 2 {
+		t.Fatalf("Snapshot() returned %d statuses, want 2", len(snap))
+	}
+	if snap[0].TotalDatums != 1 || snap[1].TotalDatums != 1 {
+		t.Fatalf("Snapshot() = %+v, want TotalDatums 1 for both jobs", snap)
+	}
+}
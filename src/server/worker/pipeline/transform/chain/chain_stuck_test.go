@@ -0,0 +1,159 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pachyderm/pachyderm/src/server/worker/common"
+)
+
+// TestStuckReportsLongAncestorWait starts a descendant job that must wait on
+// an unfinished ancestor, and checks that once the wait outlasts
+// AncestorWaitWarnAfter, Stuck reports it.
+func TestStuckReportsLongAncestorWait(t *testing.T) {
+	hasher := &pointerHasher{}
+	const warnAfter = 20 * time.Millisecond
+	jc, err := NewJobChainWithOptions(hasher, ChainOptions{AncestorWaitWarnAfter: warnAfter})
+	if err != nil {
+		t.Fatalf("NewJobChainWithOptions: %v", err)
+	}
+	if err := jc.Initialize(newMapDatumSet()); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+
+	shared := newDatums(1)[0]
+	parent := &fakeJobData{id: "parent", datums: [][]*common.Input{shared}}
+	if _, err := jc.Start(parent); err != nil {
+		t.Fatalf("Start(parent): %v", err)
+	}
+
+	// Additive-only child whose only datum is the parent's, so it has nothing
+	// to yield and must wait for the parent to finish.
+	child := &fakeJobData{id: "child", datums: [][]*common.Input{shared}}
+	childIt, err := jc.Start(child)
+	if err != nil {
+		t.Fatalf("Start(child): %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = childIt.Next(ctx) // blocks on parent
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		stuck := jc.Stuck()
+		if len(stuck) == 1 && stuck[0].JobID == "child" {
+			if stuck[0].WaitElapsed < warnAfter {
+				t.Fatalf("WaitElapsed = %v, want >= %v", stuck[0].WaitElapsed, warnAfter)
+			}
+			found := false
+			for _, a := range stuck[0].AncestorJobs {
+				if a == "parent" {
+					found = true
+				}
+			}
+			if !found {
+				t.Fatalf("Stuck()[0].AncestorJobs = %v, want to include parent", stuck[0].AncestorJobs)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Stuck() never reported the waiting child job: %+v", stuck)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	cancel()
+	<-done
+}
+
+// TestSafeToProcessSurvivesMultipleFailedAncestors is a regression test for
+// safeToProcess panicking on a nil-interface dereference. A non-additive
+// child with two overlapping ancestors that both fail terminally leaves both
+// in jdi.ancestors at different points in the wait loop; once the first wakes
+// the child and is removed, the unyielded->yielding promotion pass still
+// walks the second, whose allDatums was already nilled out by terminalFail.
+func TestSafeToProcessSurvivesMultipleFailedAncestors(t *testing.T) {
+	hasher := &pointerHasher{}
+	jc, err := NewJobChain(hasher)
+	if err != nil {
+		t.Fatalf("NewJobChain: %v", err)
+	}
+	if err := jc.Initialize(newMapDatumSet()); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+
+	sharedA := newDatums(1)[0]
+	parentA := &fakeJobData{id: "parentA", datums: [][]*common.Input{sharedA}}
+	if _, err := jc.Start(parentA); err != nil {
+		t.Fatalf("Start(parentA): %v", err)
+	}
+
+	sharedB := newDatums(1)[0]
+	onlyB := newDatums(1)[0]
+	parentB := &fakeJobData{id: "parentB", datums: [][]*common.Input{sharedB, onlyB}}
+	if _, err := jc.Start(parentB); err != nil {
+		t.Fatalf("Start(parentB): %v", err)
+	}
+
+	// Non-additive child: overlaps both parents, lacks parentB's onlyB datum
+	// and has one datum of its own, so it depends on both.
+	own := newDatums(1)[0]
+	child := &fakeJobData{id: "child", datums: [][]*common.Input{sharedA, sharedB, own}}
+	childIt, err := jc.Start(child)
+	if err != nil {
+		t.Fatalf("Start(child): %v", err)
+	}
+
+	// Fail both parents before the child starts waiting, so both are still in
+	// its ancestors, with allDatums already nilled out, when the first one
+	// wakes it.
+	ctx := context.Background()
+	if err := jc.Fail(ctx, parentA, errors.New("boom A")); err != nil {
+		t.Fatalf("Fail(parentA): %v", err)
+	}
+	if err := jc.Fail(ctx, parentB, errors.New("boom B")); err != nil {
+		t.Fatalf("Fail(parentB): %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- drainAndAckN(childIt, 3)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("draining child after both ancestors failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("child never finished draining after both ancestors failed")
+	}
+}
+
+// drainAndAckN drains exactly n datums from jdi via Next/Ack, returning any
+// error encountered.
+func drainAndAckN(jdi JobDatumIterator, n int) error {
+	ctx := context.Background()
+	for i := 0; i < n; i++ {
+		ok, err := jdi.Next(ctx)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("Next returned false after %d of %d datums", i, n)
+		}
+		if err := jdi.Ack(jdi.Datum()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,279 @@
+package chain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pachyderm/pachyderm/src/server/worker/common"
+	"github.com/pachyderm/pachyderm/src/server/worker/datum"
+)
+
+// pointerHasher hashes a datum by the identity of its first Input pointer,
+// lazily assigning each distinct pointer a stable id. Tests that want two
+// jobs to agree a datum is "the same" share the underlying *common.Input
+// value between their fake iterators; tests that want distinct datums use
+// distinct values.
+type pointerHasher struct {
+	mu     sync.Mutex
+	ids    map[*common.Input]string
+	nextID int
+}
+
+func (h *pointerHasher) Hash(inputs []*common.Input) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.ids == nil {
+		h.ids = make(map[*common.Input]string)
+	}
+	key := inputs[0]
+	if id, ok := h.ids[key]; ok {
+		return id
+	}
+	id := fmt.Sprintf("d%d", h.nextID)
+	h.nextID++
+	h.ids[key] = id
+	return id
+}
+
+// newDatums returns n distinct single-Input datums, suitable for use as (a
+// subset of) a fakeJobData's datum list. Sharing an element between two
+// jobs' lists is how a test models overlapping/recovered datums.
+func newDatums(n int) [][]*common.Input {
+	out := make([][]*common.Input, n)
+	for i := range out {
+		out[i] = []*common.Input{{}}
+	}
+	return out
+}
+
+// fakeIterator is a minimal datum.Iterator over a fixed slice of datums.
+type fakeIterator struct {
+	datums [][]*common.Input
+	pos    int
+}
+
+func (it *fakeIterator) Reset()        { it.pos = -1 }
+func (it *fakeIterator) Len() int      { return len(it.datums) }
+func (it *fakeIterator) DatumN(i int) []*common.Input { return it.datums[i] }
+func (it *fakeIterator) Next() bool {
+	it.pos++
+	return it.pos < len(it.datums)
+}
+func (it *fakeIterator) Datum() []*common.Input { return it.datums[it.pos] }
+
+// fakeJobData is a JobData backed by a fixed datum list. Iterator returns a
+// fresh *fakeIterator each call, mirroring how a retried job obtains a fresh
+// datum.Iterator while the underlying datums (and thus their hashes) stay
+// the same across attempts.
+type fakeJobData struct {
+	id     JobID
+	datums [][]*common.Input
+}
+
+func (f *fakeJobData) ID() JobID { return f.id }
+func (f *fakeJobData) Iterator() (datum.Iterator, error) {
+	return &fakeIterator{datums: f.datums, pos: -1}, nil
+}
+
+// drainAndAck calls Next/Ack until the job has no more datums available,
+// returning the number of datums it acknowledged.
+func drainAndAck(t *testing.T, ctx context.Context, jdi JobDatumIterator) int {
+	t.Helper()
+	n := 0
+	for {
+		ok, err := jdi.Next(ctx)
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		if !ok {
+			return n
+		}
+		if err := jdi.Ack(jdi.Datum()); err != nil {
+			t.Fatalf("Ack: %v", err)
+		}
+		n++
+	}
+}
+
+func TestRetryBackoffGeometric(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     100 * time.Millisecond,
+		Multiplier:     2,
+	}
+
+	cases := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 10 * time.Millisecond},
+		{2, 20 * time.Millisecond},
+		{3, 40 * time.Millisecond},
+		{4, 80 * time.Millisecond},
+		{5, 100 * time.Millisecond}, // capped
+		{6, 100 * time.Millisecond},
+	}
+	for _, c := range cases {
+		if got := retryBackoff(policy, c.attempt); got != c.want {
+			t.Errorf("retryBackoff(attempt=%d) = %v, want %v", c.attempt, got, c.want)
+		}
+	}
+}
+
+// TestFailRetriesWithoutDroppingUnackedDatum is a regression test for the
+// bug where Next/Process acked a datum before the caller actually finished
+// processing it, so a datum in flight when the caller called Fail was
+// already in `yielded` and silently skipped by recalculate on retry.
+func TestFailRetriesWithoutDroppingUnackedDatum(t *testing.T) {
+	hasher := &pointerHasher{}
+	jc, err := NewJobChainWithOptions(hasher, ChainOptions{
+		RetryPolicy: RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Multiplier: 2},
+	})
+	if err != nil {
+		t.Fatalf("NewJobChainWithOptions: %v", err)
+	}
+	if err := jc.Initialize(newMapDatumSet()); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+
+	jd := &fakeJobData{id: "job", datums: newDatums(2)}
+	jdi, err := jc.Start(jd)
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	ctx := context.Background()
+	ok, err := jdi.Next(ctx)
+	if err != nil || !ok {
+		t.Fatalf("Next = %v, %v, want a datum", ok, err)
+	}
+	// Deliberately don't Ack - simulate a failure partway through processing
+	// this datum - then fail the whole job.
+	if err := jc.Fail(ctx, jd, errors.New("boom")); err != nil {
+		t.Fatalf("Fail: %v", err)
+	}
+	if got := jdi.Attempt(); got != 1 {
+		t.Fatalf("Attempt() = %d, want 1", got)
+	}
+
+	acked := drainAndAck(t, ctx, jdi)
+	if acked != 2 {
+		t.Fatalf("acked %d datums after retry, want 2 (the unacked datum must not be dropped)", acked)
+	}
+}
+
+// TestRecalculateDoesNotDuplicateAncestorsAcrossRetries is a regression test
+// for recalculate appending to jdi.ancestors instead of resetting it, which
+// let a non-additive job accumulate duplicate (and eventually stale,
+// finished) ancestor pointers across retries.
+func TestRecalculateDoesNotDuplicateAncestorsAcrossRetries(t *testing.T) {
+	hasher := &pointerHasher{}
+	jc, err := NewJobChainWithOptions(hasher, ChainOptions{
+		RetryPolicy: RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Multiplier: 1},
+	})
+	if err != nil {
+		t.Fatalf("NewJobChainWithOptions: %v", err)
+	}
+	if err := jc.Initialize(newMapDatumSet()); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+
+	shared := newDatums(1)[0]
+	parent := &fakeJobData{id: "parent", datums: [][]*common.Input{shared, newDatums(1)[0]}}
+	if _, err := jc.Start(parent); err != nil {
+		t.Fatalf("Start(parent): %v", err)
+	}
+
+	// child is non-additive relative to parent: it has the overlapping datum
+	// but lacks the parent's other one, so datumSetIsSubset(parent, child) is
+	// false and recalculate takes the "else" branch that appends ancestors.
+	child := &fakeJobData{id: "child", datums: [][]*common.Input{shared, newDatums(1)[0]}}
+	childIt, err := jc.Start(child)
+	if err != nil {
+		t.Fatalf("Start(child): %v", err)
+	}
+	childJDI := childIt.(*jobDatumIterator)
+
+	if got := len(childJDI.ancestors); got != 1 {
+		t.Fatalf("ancestors after Start = %d, want 1", got)
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if err := jc.Fail(ctx, child, errors.New("retry me")); err != nil {
+			t.Fatalf("Fail: %v", err)
+		}
+		if got := len(childJDI.ancestors); got != 1 {
+			t.Fatalf("ancestors after retry %d = %d, want 1 (not duplicated)", i+1, got)
+		}
+	}
+}
+
+// TestFailReResolvesJobIndexAfterSleep is a regression test for Fail reusing
+// a job index captured before it released jc.mutex for the backoff sleep. A
+// concurrent Succeed on an earlier job shifts every later index; reusing the
+// stale index could slice a job in as its own ancestor.
+func TestFailReResolvesJobIndexAfterSleep(t *testing.T) {
+	hasher := &pointerHasher{}
+	jc, err := NewJobChainWithOptions(hasher, ChainOptions{
+		RetryPolicy: RetryPolicy{MaxAttempts: 2, InitialBackoff: 75 * time.Millisecond, Multiplier: 1},
+	})
+	if err != nil {
+		t.Fatalf("NewJobChainWithOptions: %v", err)
+	}
+	if err := jc.Initialize(newMapDatumSet()); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+
+	job0 := &fakeJobData{id: "job0", datums: newDatums(1)}
+	jdi0, err := jc.Start(job0)
+	if err != nil {
+		t.Fatalf("Start(job0): %v", err)
+	}
+	job1 := &fakeJobData{id: "job1", datums: newDatums(1)} // disjoint from job0
+	jdi1, err := jc.Start(job1)
+	if err != nil {
+		t.Fatalf("Start(job1): %v", err)
+	}
+
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := jc.Fail(ctx, job1, errors.New("retry me")); err != nil {
+			t.Errorf("Fail(job1): %v", err)
+		}
+	}()
+
+	// Give Fail(job1) time to capture its index and start sleeping before
+	// job0 finishes and shifts the jobs slice out from under it.
+	time.Sleep(10 * time.Millisecond)
+	if acked := drainAndAck(t, ctx, jdi0); acked != 1 {
+		t.Fatalf("drained %d datums from job0, want 1", acked)
+	}
+	if err := jc.Succeed(job0, nil); err != nil {
+		t.Fatalf("Succeed(job0): %v", err)
+	}
+
+	wg.Wait()
+
+	jdi1Concrete := jdi1.(*jobDatumIterator)
+	for _, ancestor := range jdi1Concrete.ancestors {
+		if ancestor == jdi1Concrete {
+			t.Fatalf("job1 ended up listing itself as its own ancestor")
+		}
+	}
+
+	ctxTimeout, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if acked := drainAndAck(t, ctxTimeout, jdi1); acked != 1 {
+		t.Fatalf("drained %d datums from job1 after retry, want 1 (job1 must not deadlock waiting on itself)", acked)
+	}
+}
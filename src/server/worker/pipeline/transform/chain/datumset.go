@@ -0,0 +1,777 @@
+package chain
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// DatumSet is a set of datum hashes. JobChain uses one per job (and one for
+// the chain-wide base datums) to track which datums have been seen, yielded,
+// acknowledged, etc. The default implementation (see NewMapDatumSetFactory)
+// keeps everything in memory, which is unsustainable for additive-only
+// pipelines with very large datum counts; NewDiskDatumSetFactory trades some
+// CPU for a bounded memory footprint by spilling to disk.
+type DatumSet interface {
+	// Add inserts hash into the set. It is a no-op if hash is already present.
+	Add(hash string)
+	// Contains reports whether hash is in the set.
+	Contains(hash string) bool
+	// Delete removes hash from the set. It is a no-op if hash is absent.
+	Delete(hash string)
+	// Len returns the number of hashes currently in the set.
+	Len() int
+	// Iterate returns an iterator over the set's hashes in ascending sorted
+	// order. Sorted iteration lets two DatumSets be compared via a streaming
+	// merge-join (see datumSetIsSubset/datumSetIntersect) instead of either
+	// one being materialized in memory. The caller must Close the iterator.
+	Iterate() DatumSetIterator
+	// Close releases any resources (e.g. on-disk files) held by the set.
+	Close() error
+}
+
+// DatumSetIterator yields the hashes of a DatumSet in ascending sorted order.
+type DatumSetIterator interface {
+	// Next advances the iterator and reports whether a hash is available.
+	Next() (hash string, ok bool)
+	// Close releases any resources held by the iterator.
+	Close() error
+}
+
+// DatumSetFactory constructs an empty DatumSet. A JobChain calls it once per
+// datum set it needs (a job's allDatums/unyielded/yielding/yielded/inFlight;
+// the chain's baseDatums are not built by it), so an implementation that spills to disk
+// should give each returned DatumSet its own storage.
+type DatumSetFactory func() (DatumSet, error)
+
+// NewMapDatumSetFactory returns a DatumSetFactory backed by an in-memory map.
+// This is the default used by NewJobChain/NewJobChainWithOptions.
+func NewMapDatumSetFactory() DatumSetFactory {
+	return func() (DatumSet, error) {
+		return newMapDatumSet(), nil
+	}
+}
+
+// datumSetContains is a nil-safe wrapper around DatumSet.Contains. A
+// finished-and-failed job's allDatums is deliberately set to nil by
+// terminalFail, and the original map-based DatumSet allowed reads of a nil
+// map, so callers that may see such a job rely on the same behavior here.
+func datumSetContains(ds DatumSet, hash string) bool {
+	if ds == nil {
+		return false
+	}
+	return ds.Contains(hash)
+}
+
+// datumSetLen is the nil-safe counterpart to datumSetContains.
+func datumSetLen(ds DatumSet) int {
+	if ds == nil {
+		return 0
+	}
+	return ds.Len()
+}
+
+// datumSetIsSubset reports whether every hash in a is also in b, via a
+// streaming merge-join over their sorted iterators rather than testing each
+// hash of a against b individually. A nil a is vacuously a subset of
+// anything, matching the old behavior of ranging over a nil map.
+func datumSetIsSubset(a, b DatumSet) bool {
+	if a == nil {
+		return true
+	}
+
+	ai := a.Iterate()
+	defer ai.Close()
+	bi := datumSetIterate(b)
+	defer bi.Close()
+
+	ah, aok := ai.Next()
+	bh, bok := bi.Next()
+	for aok {
+		for bok && bh < ah {
+			bh, bok = bi.Next()
+		}
+		if !bok || bh != ah {
+			return false
+		}
+		ah, aok = ai.Next()
+	}
+	return true
+}
+
+// datumSetIntersect calls fn, in ascending sorted order, for every hash
+// present in both a and b, via the same streaming merge-join used by
+// datumSetIsSubset. Neither set is materialized in memory to compute the
+// intersection.
+func datumSetIntersect(a, b DatumSet, fn func(hash string)) {
+	if a == nil || b == nil {
+		return
+	}
+
+	ai := a.Iterate()
+	defer ai.Close()
+	bi := b.Iterate()
+	defer bi.Close()
+
+	ah, aok := ai.Next()
+	bh, bok := bi.Next()
+	for aok && bok {
+		switch {
+		case ah == bh:
+			fn(ah)
+			ah, aok = ai.Next()
+			bh, bok = bi.Next()
+		case ah < bh:
+			ah, aok = ai.Next()
+		default:
+			bh, bok = bi.Next()
+		}
+	}
+}
+
+// datumSetIterate is the nil-safe counterpart to a.Iterate().
+func datumSetIterate(ds DatumSet) DatumSetIterator {
+	if ds == nil {
+		return &sliceDatumSetIterator{}
+	}
+	return ds.Iterate()
+}
+
+// mapDatumSet is the default, in-memory DatumSet implementation.
+type mapDatumSet struct {
+	hashes map[string]struct{}
+}
+
+func newMapDatumSet() DatumSet {
+	return &mapDatumSet{hashes: make(map[string]struct{})}
+}
+
+func (s *mapDatumSet) Add(hash string) {
+	s.hashes[hash] = struct{}{}
+}
+
+func (s *mapDatumSet) Contains(hash string) bool {
+	_, ok := s.hashes[hash]
+	return ok
+}
+
+func (s *mapDatumSet) Delete(hash string) {
+	delete(s.hashes, hash)
+}
+
+func (s *mapDatumSet) Len() int {
+	return len(s.hashes)
+}
+
+func (s *mapDatumSet) Iterate() DatumSetIterator {
+	hashes := make([]string, 0, len(s.hashes))
+	for hash := range s.hashes {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return &sliceDatumSetIterator{hashes: hashes}
+}
+
+func (s *mapDatumSet) Close() error {
+	return nil
+}
+
+// sliceDatumSetIterator iterates a pre-sorted slice of hashes. It backs both
+// mapDatumSet.Iterate and the in-memory portion of diskDatumSet.Iterate.
+type sliceDatumSetIterator struct {
+	hashes []string
+	pos    int
+}
+
+func (it *sliceDatumSetIterator) Next() (string, bool) {
+	if it.pos >= len(it.hashes) {
+		return "", false
+	}
+	hash := it.hashes[it.pos]
+	it.pos++
+	return hash, true
+}
+
+func (it *sliceDatumSetIterator) Close() error {
+	return nil
+}
+
+// defaultDiskDatumSetMemoryLimit is the number of hashes diskDatumSet keeps
+// in memory before spilling a sorted run to disk.
+const defaultDiskDatumSetMemoryLimit = 1 << 20
+
+// diskDatumSetRunIndexStride is how many hashes separate consecutive entries
+// in a run's sparse in-memory index (see datumSetRun.index).
+const diskDatumSetRunIndexStride = 256
+
+// DiskDatumSetOptions configures a disk-spilling DatumSet.
+type DiskDatumSetOptions struct {
+	// Dir is the directory in which spilled sorted-run files are created. An
+	// empty Dir uses the OS default temp directory.
+	Dir string
+	// MemoryLimit is the maximum number of hashes kept in memory before the
+	// set spills a sorted run to disk. A value <= 0 uses
+	// defaultDiskDatumSetMemoryLimit.
+	MemoryLimit int
+}
+
+// NewDiskDatumSetFactory returns a DatumSetFactory that keeps at most
+// opts.MemoryLimit hashes in memory per set and spills the rest to sorted
+// run files under opts.Dir, so that a JobChain processing very large
+// additive-only pipelines doesn't need to hold every datum hash in memory at
+// once. Pass this as ChainOptions.DatumSetFactory.
+func NewDiskDatumSetFactory(opts DiskDatumSetOptions) DatumSetFactory {
+	return func() (DatumSet, error) {
+		return newDiskDatumSet(opts)
+	}
+}
+
+// diskDatumSet is a DatumSet that keeps up to memLimit hashes in memory and
+// spills the rest to sorted run files on disk once that limit is reached.
+// Membership tests against a spilled run first consult a bloom filter (to
+// cheaply rule out the common case of "definitely not present") and, on a
+// possible hit, binary-search a sparse in-memory index to locate the byte
+// range worth scanning - so neither Contains nor Iterate needs to load a
+// whole run into memory.
+//
+// Like mapDatumSet, diskDatumSet does no internal locking of its own; callers
+// (jobDatumIterator) are expected to serialize access via dataMutex.
+type diskDatumSet struct {
+	dir      string
+	memLimit int
+
+	mem     map[string]struct{} // hashes not yet spilled to disk
+	deleted map[string]struct{} // hashes removed after being spilled
+	runs    []*datumSetRun      // sorted runs already spilled, oldest first
+	count   int                 // number of live (non-deleted) hashes
+}
+
+func newDiskDatumSet(opts DiskDatumSetOptions) (DatumSet, error) {
+	memLimit := opts.MemoryLimit
+	if memLimit <= 0 {
+		memLimit = defaultDiskDatumSetMemoryLimit
+	}
+	return &diskDatumSet{
+		dir:      opts.Dir,
+		memLimit: memLimit,
+		mem:      make(map[string]struct{}),
+		deleted:  make(map[string]struct{}),
+	}, nil
+}
+
+// Add inserts hash into the set. It deliberately does not check whether hash
+// is already present in a spilled run: doing so would mean paying a bloom
+// check (and, on a false positive, opening and scanning the run file) for
+// every run on every insert, which is pathological for exactly the large
+// additive-only pipelines this set exists for - the initial population of a
+// job's allDatums is a tight Add loop over every datum hash. Every caller in
+// this package only Adds a given hash once per DatumSet unless it has since
+// been Deleted (which clears it from s.deleted again here), so this holds in
+// practice; Contains and Delete still do the full check, since they're not on
+// that hot path.
+func (s *diskDatumSet) Add(hash string) {
+	if _, ok := s.mem[hash]; ok {
+		return
+	}
+	delete(s.deleted, hash)
+	s.mem[hash] = struct{}{}
+	s.count++
+
+	if len(s.mem) >= s.memLimit {
+		// Spilling is best-effort: a failure just means this batch of hashes
+		// stays in memory, so the set remains correct, only larger than
+		// intended until the next successful spill.
+		_ = s.spill()
+	}
+}
+
+func (s *diskDatumSet) Contains(hash string) bool {
+	return s.contains(hash)
+}
+
+// contains does the full membership check: in-memory, then tombstoned, then
+// each spilled run, most-recently-written first.
+func (s *diskDatumSet) contains(hash string) bool {
+	if _, ok := s.mem[hash]; ok {
+		return true
+	}
+	if _, ok := s.deleted[hash]; ok {
+		return false
+	}
+	for i := len(s.runs) - 1; i >= 0; i-- {
+		if s.runs[i].contains(hash) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *diskDatumSet) Delete(hash string) {
+	if _, ok := s.mem[hash]; ok {
+		delete(s.mem, hash)
+		s.count--
+		// A hash re-Added after being spilled and Deleted also still sits in
+		// an older run; tombstone it so Contains/Iterate don't see that copy.
+		for _, run := range s.runs {
+			if run.contains(hash) {
+				s.deleted[hash] = struct{}{}
+				break
+			}
+		}
+		return
+	}
+	if _, alreadyDeleted := s.deleted[hash]; alreadyDeleted {
+		return
+	}
+	for _, run := range s.runs {
+		if run.contains(hash) {
+			s.deleted[hash] = struct{}{}
+			s.count--
+			if len(s.deleted) >= s.memLimit {
+				// Tombstones otherwise grow without bound for a long-running
+				// additive job that deletes as it goes (e.g. recovered
+				// datums), defeating the point of spilling in the first
+				// place - compaction is best-effort for the same reason
+				// spilling is: a failure just leaves deleted larger than
+				// intended until the next successful compaction.
+				_ = s.compact()
+			}
+			return
+		}
+	}
+}
+
+func (s *diskDatumSet) Len() int {
+	return s.count
+}
+
+func (s *diskDatumSet) Iterate() DatumSetIterator {
+	memHashes := make([]string, 0, len(s.mem))
+	for hash := range s.mem {
+		memHashes = append(memHashes, hash)
+	}
+	sort.Strings(memHashes)
+
+	runIters := make([]*datumSetRunIterator, len(s.runs))
+	for i, run := range s.runs {
+		runIters[i] = run.iterate()
+	}
+
+	return &diskDatumSetIterator{
+		mem:     &sliceDatumSetIterator{hashes: memHashes},
+		runs:    runIters,
+		deleted: s.deleted,
+	}
+}
+
+func (s *diskDatumSet) Close() error {
+	var firstErr error
+	for _, run := range s.runs {
+		if err := run.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.runs = nil
+	return firstErr
+}
+
+// spill sorts the in-memory hashes, writes them to a new run file alongside
+// a bloom filter and sparse index for fast lookups, and clears the
+// in-memory map.
+func (s *diskDatumSet) spill() error {
+	hashes := make([]string, 0, len(s.mem))
+	for hash := range s.mem {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+
+	run, err := writeDatumSetRun(s.dir, hashes)
+	if err != nil {
+		return err
+	}
+
+	s.runs = append(s.runs, run)
+	s.mem = make(map[string]struct{})
+	return nil
+}
+
+// compact rewrites s.runs into a single new run with every hash in
+// s.deleted dropped, then clears s.deleted. Without this, a long-running
+// additive-only job that deletes as it goes (e.g. removing recovered
+// datums) would grow s.deleted without bound, defeating the point of
+// spilling to disk in the first place.
+func (s *diskDatumSet) compact() error {
+	if len(s.runs) == 0 || len(s.deleted) == 0 {
+		return nil
+	}
+
+	iters := make([]*datumSetRunIterator, len(s.runs))
+	heads := make([]string, len(s.runs))
+	haveHead := make([]bool, len(s.runs))
+	upperBound := 0
+	for i, run := range s.runs {
+		upperBound += run.count
+		iters[i] = run.iterate()
+		heads[i], haveHead[i] = iters[i].next()
+	}
+	defer func() {
+		for _, it := range iters {
+			it.close()
+		}
+	}()
+
+	smallestHead := func() (int, string, bool) {
+		best := -1
+		for i, have := range haveHead {
+			if have && (best == -1 || heads[i] < heads[best]) {
+				best = i
+			}
+		}
+		if best == -1 {
+			return 0, "", false
+		}
+		return best, heads[best], true
+	}
+
+	// merged performs the same k-way merge (with duplicate-skipping) as
+	// diskDatumSetIterator.Next, but only over s.runs - s.mem is untouched by
+	// compaction - and additionally drops tombstoned hashes.
+	merged := func() (string, bool) {
+		for {
+			idx, hash, ok := smallestHead()
+			if !ok {
+				return "", false
+			}
+			heads[idx], haveHead[idx] = iters[idx].next()
+			for {
+				dupIdx, dupHash, dupOk := smallestHead()
+				if !dupOk || dupHash != hash {
+					break
+				}
+				heads[dupIdx], haveHead[dupIdx] = iters[dupIdx].next()
+			}
+			if _, deleted := s.deleted[hash]; deleted {
+				continue
+			}
+			return hash, true
+		}
+	}
+
+	newRun, err := writeDatumSetRunFromSource(s.dir, upperBound, merged)
+	if err != nil {
+		return err
+	}
+
+	oldRuns := s.runs
+	s.deleted = make(map[string]struct{})
+	if newRun.count == 0 {
+		// merged yielded nothing; drop the empty run file and leave s.runs empty.
+		s.runs = nil
+		oldRuns = append(oldRuns, newRun)
+	} else {
+		s.runs = []*datumSetRun{newRun}
+	}
+
+	var firstErr error
+	for _, run := range oldRuns {
+		if err := run.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// datumSetRun is one sorted, immutable batch of hashes spilled to disk.
+type datumSetRun struct {
+	path  string
+	bloom *datumSetBloomFilter
+	index []datumSetRunIndexEntry
+	count int // number of hashes written to the run, for sizing compaction
+}
+
+// datumSetRunIndexEntry sparsely indexes a run file: hash is the first hash
+// of a block of diskDatumSetRunIndexStride lines starting at byte offset.
+type datumSetRunIndexEntry struct {
+	hash   string
+	offset int64
+}
+
+func writeDatumSetRun(dir string, sortedHashes []string) (*datumSetRun, error) {
+	i := 0
+	return writeDatumSetRunFromSource(dir, len(sortedHashes), func() (string, bool) {
+		if i >= len(sortedHashes) {
+			return "", false
+		}
+		hash := sortedHashes[i]
+		i++
+		return hash, true
+	})
+}
+
+// writeDatumSetRunFromSource writes a new run file from hashes yielded by
+// next, in ascending sorted order, without requiring the caller to hold every
+// hash in memory at once - used directly by compact, which rewrites a job's
+// runs to drop tombstoned hashes. countHint sizes the run's bloom filter; an
+// overestimate (as compact supplies) just costs a little extra memory, not
+// correctness.
+func writeDatumSetRunFromSource(dir string, countHint int, next func() (string, bool)) (*datumSetRun, error) {
+	f, err := ioutil.TempFile(dir, "datumset-run-")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	run := &datumSetRun{
+		path:  f.Name(),
+		bloom: newDatumSetBloomFilter(countHint),
+	}
+
+	w := bufio.NewWriter(f)
+	var offset int64
+	for {
+		hash, ok := next()
+		if !ok {
+			break
+		}
+		if run.count%diskDatumSetRunIndexStride == 0 {
+			run.index = append(run.index, datumSetRunIndexEntry{hash: hash, offset: offset})
+		}
+		run.bloom.add(hash)
+
+		n, err := w.WriteString(hash)
+		if err != nil {
+			return nil, err
+		}
+		if err := w.WriteByte('\n'); err != nil {
+			return nil, err
+		}
+		offset += int64(n) + 1
+		run.count++
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	return run, nil
+}
+
+// contains reports whether hash is present in the run, first consulting the
+// bloom filter and only opening the file on a possible match.
+func (run *datumSetRun) contains(hash string) bool {
+	if !run.bloom.mayContain(hash) {
+		return false
+	}
+
+	f, err := os.Open(run.path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(run.seekOffset(hash), 0); err != nil {
+		return false
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == hash {
+			return true
+		}
+		if line > hash {
+			return false
+		}
+	}
+	return false
+}
+
+// seekOffset returns the byte offset of the latest indexed block that could
+// contain hash, via a binary search of the sparse index.
+func (run *datumSetRun) seekOffset(hash string) int64 {
+	i := sort.Search(len(run.index), func(i int) bool {
+		return run.index[i].hash > hash
+	})
+	if i == 0 {
+		return 0
+	}
+	return run.index[i-1].offset
+}
+
+func (run *datumSetRun) iterate() *datumSetRunIterator {
+	return &datumSetRunIterator{path: run.path}
+}
+
+func (run *datumSetRun) close() error {
+	return os.Remove(run.path)
+}
+
+// datumSetRunIterator streams a run file's hashes in sorted order without
+// loading the whole file into memory.
+type datumSetRunIterator struct {
+	path    string
+	f       *os.File
+	scanner *bufio.Scanner
+	started bool
+}
+
+func (it *datumSetRunIterator) next() (string, bool) {
+	if !it.started {
+		it.started = true
+		f, err := os.Open(it.path)
+		if err != nil {
+			return "", false
+		}
+		it.f = f
+		it.scanner = bufio.NewScanner(f)
+	}
+	if it.scanner == nil || !it.scanner.Scan() {
+		return "", false
+	}
+	return it.scanner.Text(), true
+}
+
+func (it *datumSetRunIterator) close() error {
+	if it.f == nil {
+		return nil
+	}
+	return it.f.Close()
+}
+
+// diskDatumSetIterator performs a k-way merge of the in-memory hashes and
+// every on-disk run, skipping deleted hashes, so Iterate never materializes
+// more than one hash per source at a time.
+type diskDatumSetIterator struct {
+	mem     *sliceDatumSetIterator
+	runs    []*datumSetRunIterator
+	deleted map[string]struct{}
+
+	heads    []string
+	haveHead []bool
+	started  bool
+}
+
+func (it *diskDatumSetIterator) Next() (string, bool) {
+	if !it.started {
+		it.started = true
+		it.heads = make([]string, len(it.runs)+1)
+		it.haveHead = make([]bool, len(it.runs)+1)
+		it.advance(0) // mem source
+		for i := range it.runs {
+			it.advance(i + 1)
+		}
+	}
+
+	for {
+		idx, hash, ok := it.smallestHead()
+		if !ok {
+			return "", false
+		}
+		it.advance(idx)
+		// Skip duplicates: the same hash can live in more than one source
+		// (e.g. it was re-Added to mem after an earlier run was spilled).
+		for {
+			dupIdx, dupHash, dupOk := it.smallestHead()
+			if !dupOk || dupHash != hash {
+				break
+			}
+			it.advance(dupIdx)
+		}
+		if _, deleted := it.deleted[hash]; deleted {
+			continue
+		}
+		return hash, true
+	}
+}
+
+// smallestHead returns the index and value of the lexicographically smallest
+// available head among mem and the run iterators.
+func (it *diskDatumSetIterator) smallestHead() (int, string, bool) {
+	best := -1
+	for i, have := range it.haveHead {
+		if !have {
+			continue
+		}
+		if best == -1 || it.heads[i] < it.heads[best] {
+			best = i
+		}
+	}
+	if best == -1 {
+		return 0, "", false
+	}
+	return best, it.heads[best], true
+}
+
+// advance pulls the next value for source idx (0 is mem, i+1 is it.runs[i]).
+func (it *diskDatumSetIterator) advance(idx int) {
+	var hash string
+	var ok bool
+	if idx == 0 {
+		hash, ok = it.mem.Next()
+	} else {
+		hash, ok = it.runs[idx-1].next()
+	}
+	it.heads[idx] = hash
+	it.haveHead[idx] = ok
+}
+
+func (it *diskDatumSetIterator) Close() error {
+	var firstErr error
+	for _, run := range it.runs {
+		if err := run.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// datumSetBloomFilter is a small fixed-size bloom filter used to cheaply
+// rule out "definitely not in this run" before paying for a file open.
+type datumSetBloomFilter struct {
+	bits []uint64
+	k    int
+}
+
+func newDatumSetBloomFilter(n int) *datumSetBloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	// ~10 bits per element keeps the false-positive rate low (~1%) with 4
+	// hash functions, at a fixed cost of ~1.25 bytes per element.
+	numBits := n * 10
+	return &datumSetBloomFilter{
+		bits: make([]uint64, (numBits+63)/64),
+		k:    4,
+	}
+}
+
+func (b *datumSetBloomFilter) add(hash string) {
+	for i := 0; i < b.k; i++ {
+		b.setBit(b.bitIndex(hash, i))
+	}
+}
+
+func (b *datumSetBloomFilter) mayContain(hash string) bool {
+	for i := 0; i < b.k; i++ {
+		if !b.getBit(b.bitIndex(hash, i)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *datumSetBloomFilter) bitIndex(hash string, seed int) uint64 {
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d:%s", seed, hash)
+	return h.Sum64() % uint64(len(b.bits)*64)
+}
+
+func (b *datumSetBloomFilter) setBit(i uint64) {
+	b.bits[i/64] |= 1 << (i % 64)
+}
+
+func (b *datumSetBloomFilter) getBit(i uint64) bool {
+	return b.bits[i/64]&(1<<(i%64)) != 0
+}
@@ -0,0 +1,255 @@
+package chain
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+func collectSorted(t *testing.T, ds DatumSet) []string {
+	t.Helper()
+	it := ds.Iterate()
+	defer it.Close()
+
+	var hashes []string
+	for {
+		hash, ok := it.Next()
+		if !ok {
+			break
+		}
+		hashes = append(hashes, hash)
+	}
+	if !sort.StringsAreSorted(hashes) {
+		t.Fatalf("Iterate did not yield hashes in sorted order: %v", hashes)
+	}
+	return hashes
+}
+
+// TestDiskDatumSetBasic exercises Add/Contains/Delete/Len/Iterate against a
+// diskDatumSet with a small MemoryLimit, so that most of the set ends up
+// spilled across several runs.
+func TestDiskDatumSetBasic(t *testing.T) {
+	factory := NewDiskDatumSetFactory(DiskDatumSetOptions{MemoryLimit: 4})
+	ds, err := factory()
+	if err != nil {
+		t.Fatalf("factory: %v", err)
+	}
+	defer ds.Close()
+
+	var want []string
+	for i := 0; i < 50; i++ {
+		hash := fmt.Sprintf("h%03d", i)
+		ds.Add(hash)
+		want = append(want, hash)
+	}
+	sort.Strings(want)
+
+	if got := ds.Len(); got != len(want) {
+		t.Fatalf("Len() = %d, want %d", got, len(want))
+	}
+	for _, hash := range want {
+		if !ds.Contains(hash) {
+			t.Fatalf("Contains(%q) = false, want true", hash)
+		}
+	}
+	if ds.Contains("nope") {
+		t.Fatalf("Contains(%q) = true, want false", "nope")
+	}
+
+	if got := collectSorted(t, ds); len(got) != len(want) || got[0] != want[0] {
+		t.Fatalf("Iterate() = %v, want %v", got, want)
+	}
+
+	// Delete every other hash, including some still in mem and some already
+	// spilled, and confirm both Contains and Iterate agree afterwards.
+	var remaining []string
+	for i, hash := range want {
+		if i%2 == 0 {
+			ds.Delete(hash)
+			continue
+		}
+		remaining = append(remaining, hash)
+	}
+
+	if got := ds.Len(); got != len(remaining) {
+		t.Fatalf("Len() after delete = %d, want %d", got, len(remaining))
+	}
+	for _, hash := range remaining {
+		if !ds.Contains(hash) {
+			t.Fatalf("Contains(%q) = false after survives delete, want true", hash)
+		}
+	}
+	got := collectSorted(t, ds)
+	if len(got) != len(remaining) {
+		t.Fatalf("Iterate() after delete returned %d hashes, want %d", len(got), len(remaining))
+	}
+	for i := range got {
+		if got[i] != remaining[i] {
+			t.Fatalf("Iterate()[%d] = %q, want %q", i, got[i], remaining[i])
+		}
+	}
+}
+
+// TestDiskDatumSetReAddAfterDelete confirms that deleting a spilled hash and
+// then re-Adding it (the one duplicate-Add pattern the package relies on,
+// e.g. recalculate repopulating yielding from unyielded) brings it back.
+func TestDiskDatumSetReAddAfterDelete(t *testing.T) {
+	factory := NewDiskDatumSetFactory(DiskDatumSetOptions{MemoryLimit: 2})
+	ds, err := factory()
+	if err != nil {
+		t.Fatalf("factory: %v", err)
+	}
+	defer ds.Close()
+
+	ds.Add("a")
+	ds.Add("b") // forces a spill with MemoryLimit 2
+	ds.Add("c")
+
+	ds.Delete("b")
+	if ds.Contains("b") {
+		t.Fatalf("Contains(b) = true after delete, want false")
+	}
+	if got, want := ds.Len(), 2; got != want {
+		t.Fatalf("Len() after delete = %d, want %d", got, want)
+	}
+
+	ds.Add("b")
+	if !ds.Contains("b") {
+		t.Fatalf("Contains(b) = false after re-add, want true")
+	}
+	if got, want := ds.Len(), 3; got != want {
+		t.Fatalf("Len() after re-add = %d, want %d", got, want)
+	}
+}
+
+// TestDiskDatumSetCompaction confirms that deleting enough spilled hashes to
+// cross MemoryLimit triggers a compaction that rewrites the runs without the
+// tombstoned hashes, and that the set's contents are unaffected.
+func TestDiskDatumSetCompaction(t *testing.T) {
+	const memLimit = 8
+	factory := NewDiskDatumSetFactory(DiskDatumSetOptions{MemoryLimit: memLimit})
+	ds, err := factory()
+	if err != nil {
+		t.Fatalf("factory: %v", err)
+	}
+	defer ds.Close()
+
+	dds := ds.(*diskDatumSet)
+
+	var all []string
+	for i := 0; i < 100; i++ {
+		hash := fmt.Sprintf("h%03d", i)
+		ds.Add(hash)
+		all = append(all, hash)
+	}
+	if len(dds.runs) < 2 {
+		t.Fatalf("expected multiple spilled runs, got %d", len(dds.runs))
+	}
+
+	// Delete enough hashes to cross the compaction threshold (memLimit
+	// tombstones) at least once.
+	var deleted, remaining []string
+	for i, hash := range all {
+		if i%3 == 0 {
+			ds.Delete(hash)
+			deleted = append(deleted, hash)
+		} else {
+			remaining = append(remaining, hash)
+		}
+	}
+	if len(deleted) < memLimit {
+		t.Fatalf("test setup deleted only %d hashes, want at least %d to trigger compaction", len(deleted), memLimit)
+	}
+	if len(dds.deleted) >= memLimit {
+		t.Fatalf("deleted tombstones = %d, want compaction to have kept it under %d", len(dds.deleted), memLimit)
+	}
+
+	if got := ds.Len(); got != len(remaining) {
+		t.Fatalf("Len() after compaction = %d, want %d", got, len(remaining))
+	}
+	for _, hash := range deleted {
+		if ds.Contains(hash) {
+			t.Fatalf("Contains(%q) = true after compaction, want false", hash)
+		}
+	}
+	for _, hash := range remaining {
+		if !ds.Contains(hash) {
+			t.Fatalf("Contains(%q) = false after compaction, want true", hash)
+		}
+	}
+	got := collectSorted(t, ds)
+	if len(got) != len(remaining) {
+		t.Fatalf("Iterate() after compaction returned %d hashes, want %d", len(got), len(remaining))
+	}
+}
+
+// TestDatumSetMergeJoin checks datumSetIsSubset/datumSetIntersect against
+// both mapDatumSet and diskDatumSet implementations, including a nil set.
+func TestDatumSetMergeJoin(t *testing.T) {
+	build := func(factory DatumSetFactory, hashes ...string) DatumSet {
+		ds, err := factory()
+		if err != nil {
+			t.Fatalf("factory: %v", err)
+		}
+		for _, h := range hashes {
+			ds.Add(h)
+		}
+		return ds
+	}
+
+	factories := map[string]DatumSetFactory{
+		"map":  NewMapDatumSetFactory(),
+		"disk": NewDiskDatumSetFactory(DiskDatumSetOptions{MemoryLimit: 2}),
+	}
+
+	for name, factory := range factories {
+		t.Run(name, func(t *testing.T) {
+			parent := build(factory, "a", "b", "c")
+			child := build(factory, "a", "b", "c", "d")
+			defer parent.Close()
+			defer child.Close()
+
+			if !datumSetIsSubset(parent, child) {
+				t.Fatalf("expected parent to be a subset of child")
+			}
+			if datumSetIsSubset(child, parent) {
+				t.Fatalf("expected child not to be a subset of parent")
+			}
+			if !datumSetIsSubset(nil, child) {
+				t.Fatalf("expected nil set to be vacuously a subset")
+			}
+
+			var got []string
+			datumSetIntersect(parent, child, func(hash string) { got = append(got, hash) })
+			want := []string{"a", "b", "c"}
+			if len(got) != len(want) {
+				t.Fatalf("intersect() = %v, want %v", got, want)
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Fatalf("intersect()[%d] = %q, want %q", i, got[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+// TestDatumSetBloomFilterNoFalseNegatives confirms the bloom filter used by
+// datumSetRun never reports a false negative, which run.contains relies
+// on to safely skip opening the file.
+func TestDatumSetBloomFilterNoFalseNegatives(t *testing.T) {
+	var hashes []string
+	for i := 0; i < 500; i++ {
+		hashes = append(hashes, fmt.Sprintf("bloom-%d", i))
+	}
+
+	bloom := newDatumSetBloomFilter(len(hashes))
+	for _, h := range hashes {
+		bloom.add(h)
+	}
+	for _, h := range hashes {
+		if !bloom.mayContain(h) {
+			t.Fatalf("mayContain(%q) = false after add, want true (false negative)", h)
+		}
+	}
+}